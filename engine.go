@@ -0,0 +1,599 @@
+package renderlayout
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/template/parse"
+
+	"github.com/foolin/goview"
+)
+
+// engine renders views within a master layout along with the partials. It follows goview.ViewEngine and
+// reuses its configuration and file handling, but also applies template options(e.g. missingkey).
+// Parsed templates are cached unexecuted, and executed through their instances, so funcs bound to a render, like
+// include, never see the data of a concurrent render.
+type engine struct {
+	// hits and misses of the template cache are accessed atomically, first for 64-bit alignment.
+	hits   uint64
+	misses uint64
+
+	config      goview.Config
+	options     []string
+	tplMap      map[tplKey]*cachedTemplate
+	staticMap   map[string]template.HTML
+	tplMutex    sync.RWMutex
+	fileHandler goview.FileHandler
+
+	// lazyPartials parses only the partials a template references.
+	lazyPartials bool
+	// placeholderFuncs renders a placeholder for calls to undefined funcs instead of failing to parse.
+	placeholderFuncs bool
+	// layoutPartials are the partials scoped to a master layout by the master layout.
+	layoutPartials map[string][]string
+	// skipBrokenPartials leaves out the partials failing to parse with a warning instead of failing the template.
+	skipBrokenPartials bool
+	// callFunc reports whether the func is added by a render, so a template calling it parses without it.
+	callFunc func(name string) bool
+	// partialAliases are the template names of the partials by their alias.
+	partialAliases map[string]string
+}
+
+// contentBlock is the block a layout renders the view with, i.e. {{template "content" .}}
+const contentBlock = "content"
+
+// inlineTemplate is the name of a template rendered from source.
+const inlineTemplate = "inline"
+
+// cachedTemplate is a parsed template, which is cloned for the instances executed by the renders, but never executed
+// itself. An instance is executed by one render at a time and then reused. html/template escapes an instance when it's
+// first executed, so the templates are escaped once per instance rather than for every render.
+type cachedTemplate struct {
+	*template.Template
+	instances sync.Pool
+}
+
+// instance returns an instance of the template, reused or cloned.
+func (c *cachedTemplate) instance() (*template.Template, error) {
+	if instance, ok := c.instances.Get().(*template.Template); ok {
+		return instance, nil
+	}
+	return c.Clone()
+}
+
+// release returns the instance for the next render.
+func (c *cachedTemplate) release(instance *template.Template) {
+	c.instances.Put(instance)
+}
+
+// tplKey identifies a parsed template. master is empty if the template is rendered without the master layout.
+type tplKey struct {
+	name   string
+	master string
+}
+
+func newEngine(config goview.Config, options ...string) *engine {
+	return &engine{
+		config:      config,
+		options:     options,
+		tplMap:      make(map[tplKey]*cachedTemplate),
+		staticMap:   make(map[string]template.HTML),
+		fileHandler: goview.DefaultFileHandler(),
+	}
+}
+
+// RenderWriter renders the view with io.Writer. funcs are bound to the templates for this render only.
+func (e *engine) RenderWriter(w io.Writer, name string, data interface{}, funcs template.FuncMap) error {
+	return e.executeRender(w, name, data, funcs)
+}
+
+// Warm parses and caches the view template.
+func (e *engine) Warm(name string) error {
+	if e.config.DisableCache {
+		return nil
+	}
+	name, useMaster := e.view(name)
+	master := ""
+	if useMaster {
+		master = e.config.Master
+	}
+	_, err := e.template(name, master)
+	return err
+}
+
+// Dependencies returns the layout, partial and included files the view is rendered with.
+func (e *engine) Dependencies(name string) ([]string, error) {
+	name, useMaster := e.view(name)
+	master := ""
+	if useMaster {
+		master = e.config.Master
+	}
+	tpl, err := e.template(name, master)
+	if err != nil {
+		return nil, err
+	}
+	exeName := name
+	if master != "" {
+		exeName = master
+	}
+	lookup := func(tpl *cachedTemplate) func(name string) *parse.Tree {
+		return func(name string) *parse.Tree {
+			if t := tpl.Lookup(name); t != nil {
+				return t.Tree
+			}
+			return nil
+		}
+	}
+	return dependencies(exeName, name, lookup(tpl), func(name string) func(name string) *parse.Tree {
+		tpl, err := e.template(name, "")
+		if err != nil {
+			return nil
+		}
+		return lookup(tpl)
+	}), nil
+}
+
+func (e *engine) executeRender(out io.Writer, name string, data interface{}, funcs template.FuncMap) error {
+	name, useMaster := e.view(name)
+	return e.executeTemplate(out, name, data, useMaster, funcs)
+}
+
+// RenderLayout renders the view like RenderWriter, but within the master layout, unless it's empty.
+func (e *engine) RenderLayout(w io.Writer, name, master string, data interface{}, funcs template.FuncMap) error {
+	name, useMaster := e.view(name)
+	if !useMaster {
+		return e.executeMaster(w, name, "", data, funcs)
+	}
+	return e.executeMaster(w, name, e.layoutMaster(master), data, funcs)
+}
+
+// layoutMaster returns the master layout, or the configured one if it's empty.
+func (e *engine) layoutMaster(master string) string {
+	if master == "" {
+		return e.config.Master
+	}
+	return master
+}
+
+// view returns the template name of the view, and whether it's rendered with the master layout.
+// The template extension is optional, e.g. "home.html" is the view "home". A standalone view, which has the extension
+// of a known content type(e.g. sitemap.xml), is rendered without the master layout.
+func (e *engine) view(name string) (string, bool) {
+	name = strings.TrimSuffix(name, e.config.Extension)
+	return name, !standalone(name)
+}
+
+func (e *engine) executeTemplate(out io.Writer, name string, data interface{}, useMaster bool,
+	funcs template.FuncMap) error {
+	master := ""
+	if useMaster {
+		master = e.config.Master
+	}
+	return e.executeMaster(out, name, master, data, funcs)
+}
+
+// executeMaster executes the template of the view within the master layout, or the view alone without a master.
+func (e *engine) executeMaster(out io.Writer, name, master string, data interface{}, funcs template.FuncMap) error {
+	tpl, err := e.template(name, master)
+	if err != nil {
+		return err
+	}
+
+	exeName := name
+	if master != "" {
+		exeName = master
+	}
+	return e.execute(out, tpl, exeName, data, funcs)
+}
+
+// RenderFragment renders the view without the master layout. If the view defines the content block, only the
+// block is rendered, otherwise the whole view. funcs are bound to the templates for this render only.
+func (e *engine) RenderFragment(out io.Writer, name string, data interface{}, funcs template.FuncMap) error {
+	name, _ = e.view(name)
+	tpl, err := e.template(name, "")
+	if err != nil {
+		return err
+	}
+
+	exeName := name
+	if tpl.Lookup(contentBlock) != nil {
+		exeName = contentBlock
+	}
+	return e.execute(out, tpl, exeName, data, funcs)
+}
+
+// execute executes the named template of an instance of tpl, with the funcs bound to the data and the render funcs.
+func (e *engine) execute(out io.Writer, tpl *cachedTemplate, exeName string, data interface{},
+	funcs template.FuncMap) error {
+	instance, err := tpl.instance()
+	if err != nil {
+		return err
+	}
+	renderFuncs := template.FuncMap{
+		"include": func(layout string) (template.HTML, error) {
+			return e.include(layout, data, funcs)
+		},
+	}
+	for k, v := range funcs {
+		renderFuncs[k] = v
+	}
+	instance.Funcs(renderFuncs)
+
+	err = instance.ExecuteTemplate(out, exeName, data)
+	instance.Funcs(e.parseFuncs(renderFuncs))
+	tpl.release(instance)
+	if err != nil {
+		return fmt.Errorf("ViewEngine execute template error: %v", err)
+	}
+
+	return nil
+}
+
+// parseFuncs returns the funcs the templates are parsed with, by the names of funcs. They unbind the funcs bound by a
+// render from an instance, so the next render of the instance doesn't call them.
+func (e *engine) parseFuncs(funcs template.FuncMap) template.FuncMap {
+	parseFuncs := make(template.FuncMap, len(funcs))
+	for name := range funcs {
+		if name == "include" {
+			parseFuncs[name] = noInclude
+		} else if fn, ok := e.config.Funcs[name]; ok {
+			parseFuncs[name] = fn
+		} else if e.placeholderFuncs && (e.callFunc == nil || !e.callFunc(name)) {
+			parseFuncs[name] = placeholderFunc(name)
+		} else {
+			parseFuncs[name] = unboundFunc(name)
+		}
+	}
+	return parseFuncs
+}
+
+// include renders the template without the master layout for the include func. The output of a static template, i.e.
+// without any actions, is cached.
+func (e *engine) include(name string, data interface{}, funcs template.FuncMap) (template.HTML, error) {
+	if !e.config.DisableCache {
+		e.tplMutex.RLock()
+		html, ok := e.staticMap[name]
+		e.tplMutex.RUnlock()
+		if ok {
+			return html, nil
+		}
+	}
+
+	tpl, err := e.template(name, "")
+	if err != nil {
+		return "", err
+	}
+	buf := new(bytes.Buffer)
+	if err := e.execute(buf, tpl, name, data, funcs); err != nil {
+		return "", err
+	}
+	html := template.HTML(buf.String())
+
+	if !e.config.DisableCache && isStatic(tpl.Template) {
+		e.tplMutex.Lock()
+		e.staticMap[name] = html
+		e.tplMutex.Unlock()
+	}
+	return html, nil
+}
+
+// template returns the parsed template for the view name, parsing it if it isn't cached. With the cache disabled, it's
+// parsed and not cached.
+func (e *engine) template(name, master string) (*cachedTemplate, error) {
+	if e.config.DisableCache {
+		tpl, err := e.parseTemplate(name, master, "")
+		if err != nil {
+			return nil, err
+		}
+		return &cachedTemplate{Template: tpl}, nil
+	}
+
+	key := tplKey{name: name, master: master}
+	e.tplMutex.RLock()
+	tpl, ok := e.tplMap[key]
+	e.tplMutex.RUnlock()
+	if ok {
+		atomic.AddUint64(&e.hits, 1)
+		return tpl, nil
+	}
+	atomic.AddUint64(&e.misses, 1)
+
+	parsed, err := e.parseTemplate(name, master, "")
+	if err != nil {
+		return nil, err
+	}
+
+	tpl = &cachedTemplate{Template: parsed}
+	e.tplMutex.Lock()
+	e.tplMap[key] = tpl
+	e.tplMutex.Unlock()
+	return tpl, nil
+}
+
+// parseTemplate parses the template for the view name with the master layout and the partials. The view is parsed
+// from src, unless it's empty.
+func (e *engine) parseTemplate(name, master, src string) (*template.Template, error) {
+	tpl := e.newTemplate(name)
+	if master != "" {
+		if err := e.parse(tpl, master); err != nil {
+			return nil, err
+		}
+	}
+	var err error
+	if src != "" {
+		err = e.parseSource(tpl, name, src)
+	} else {
+		err = e.parse(tpl, name)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := e.parsePartials(tpl, master); err != nil {
+		return nil, err
+	}
+	return tpl, nil
+}
+
+// parsePartials parses the partials available with the master layout into tpl, or only those it references with lazy
+// partials, and defines the partial aliases.
+func (e *engine) parsePartials(tpl *template.Template, master string) error {
+	if e.lazyPartials {
+		if err := e.parseReferencedPartials(tpl, master); err != nil {
+			return err
+		}
+	} else {
+		for _, partial := range e.partials(master) {
+			if err := e.parsePartial(tpl, partial); err != nil {
+				return err
+			}
+		}
+	}
+	for alias, partial := range e.partialAliases {
+		if t := tpl.Lookup(partial); t != nil && tpl.Lookup(alias) == nil {
+			if _, err := tpl.AddParseTree(alias, t.Tree); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// RenderSource renders the view like RenderLayout, or like RenderFragment for a fragment, but parsed from src instead
+// of the view's file. It isn't cached.
+func (e *engine) RenderSource(out io.Writer, name, master, src string, data interface{}, fragment bool,
+	funcs template.FuncMap) error {
+	name, useMaster := e.view(name)
+	if useMaster && !fragment {
+		master = e.layoutMaster(master)
+	} else {
+		master = ""
+	}
+	tpl, err := e.parseTemplate(name, master, src)
+	if err != nil {
+		return err
+	}
+
+	exeName := name
+	if master != "" {
+		exeName = master
+	} else if fragment && tpl.Lookup(contentBlock) != nil {
+		exeName = contentBlock
+	}
+	return e.execute(out, &cachedTemplate{Template: tpl}, exeName, data, funcs)
+}
+
+// cacheStats returns the statistics of the template cache.
+func (e *engine) cacheStats() CacheStats {
+	e.tplMutex.RLock()
+	size := len(e.tplMap)
+	e.tplMutex.RUnlock()
+	return CacheStats{
+		Hits:   atomic.LoadUint64(&e.hits),
+		Misses: atomic.LoadUint64(&e.misses),
+		Size:   size,
+	}
+}
+
+// newTemplate returns an empty template with the funcs, delimiters and options.
+func (e *engine) newTemplate(name string) *template.Template {
+	return template.New(name).
+		Funcs(e.funcs()).
+		Delims(e.config.Delims.Left, e.config.Delims.Right).
+		Option(e.options...)
+}
+
+// RenderBlock renders the named template defined by the view or the partials, without the master layout.
+func (e *engine) RenderBlock(out io.Writer, name, block string, data interface{}, funcs template.FuncMap) error {
+	name, _ = e.view(name)
+	tpl, err := e.template(name, "")
+	if err != nil {
+		return err
+	}
+	if tpl.Lookup(block) == nil {
+		return fmt.Errorf("ViewEngine render block name:%v, error: block %q not defined", name, block)
+	}
+	return e.execute(out, tpl, block, data, funcs)
+}
+
+// RenderInline renders the template source along with the partials, without the master layout. It isn't cached.
+func (e *engine) RenderInline(out io.Writer, src string, data interface{}, funcs template.FuncMap) error {
+	tpl, err := e.newTemplate(inlineTemplate).Parse(src)
+	if err != nil {
+		return fmt.Errorf("ViewEngine render parser name:%v, error: %v", inlineTemplate, err)
+	}
+	if err := e.parsePartials(tpl, ""); err != nil {
+		return err
+	}
+	return e.execute(out, &cachedTemplate{Template: tpl}, inlineTemplate, data, funcs)
+}
+
+// RenderSandboxed renders the template source with only the funcs, without the partials. It isn't cached.
+func (e *engine) RenderSandboxed(out io.Writer, src string, data interface{}, funcs template.FuncMap) error {
+	tpl, err := template.New(inlineTemplate).
+		Funcs(funcs).
+		Delims(e.config.Delims.Left, e.config.Delims.Right).
+		Option(e.options...).
+		Parse(src)
+	if err != nil {
+		return fmt.Errorf("ViewEngine render parser name:%v, error: %v", inlineTemplate, err)
+	}
+	if err := tpl.Execute(out, data); err != nil {
+		return fmt.Errorf("ViewEngine execute template error: %v", err)
+	}
+	return nil
+}
+
+// parse parses the template file into tpl, or an associated template named after the file.
+func (e *engine) parse(tpl *template.Template, tplFile string) error {
+	data, err := e.fileHandler(e.config, tplFile)
+	if err != nil {
+		return err
+	}
+	return e.parseSource(tpl, tplFile, data)
+}
+
+// parseSource parses the source of the template file into tpl, or an associated template named after the file.
+func (e *engine) parseSource(tpl *template.Template, tplFile, data string) error {
+	tmpl := tpl
+	if tplFile != tpl.Name() {
+		tmpl = tpl.New(tplFile)
+	}
+	_, err := tmpl.Parse(data)
+	for err != nil {
+		// define the missing func as a placeholder, or a func bound by the render, and parse again.
+		match := undefinedFunc.FindStringSubmatch(err.Error())
+		if match == nil {
+			break
+		}
+		if e.callFunc != nil && e.callFunc(match[1]) {
+			tpl.Funcs(template.FuncMap{match[1]: unboundFunc(match[1])})
+		} else if e.placeholderFuncs {
+			tpl.Funcs(template.FuncMap{match[1]: placeholderFunc(match[1])})
+		} else {
+			break
+		}
+		_, err = tmpl.Parse(data)
+	}
+	if err != nil {
+		return fmt.Errorf("ViewEngine render parser name:%v, error: %v", tplFile, err)
+	}
+	return nil
+}
+
+// undefinedFunc matches the parse error of a call to an undefined func.
+var undefinedFunc = regexp.MustCompile(`function "([^"]+)" not defined`)
+
+// placeholderFunc returns a func rendering a placeholder in place of the missing func name.
+func placeholderFunc(name string) func(...interface{}) string {
+	return func(...interface{}) string {
+		return fmt.Sprintf("[missing func: %s]", name)
+	}
+}
+
+// unboundFunc returns a func failing the render in place of a func added by another render, which isn't added to
+// this render.
+func unboundFunc(name string) func(...interface{}) (string, error) {
+	return func(...interface{}) (string, error) {
+		return "", fmt.Errorf("function %q not added to the render", name)
+	}
+}
+
+// parseReferencedPartials parses the partials referenced by tpl, and then by the parsed partials, until every
+// reference is defined or there's no partial for it. A partial is referenced by its name, e.g. "partials/main", or its
+// file name, e.g. "main".
+func (e *engine) parseReferencedPartials(tpl *template.Template, master string) error {
+	parsed := make(map[string]bool)
+	for {
+		more := false
+		for _, ref := range undefinedRefs(tpl) {
+			partial, ok := e.partial(ref, master)
+			if !ok || parsed[partial] {
+				continue
+			}
+			parsed[partial] = true
+			if err := e.parsePartial(tpl, partial); err != nil {
+				return err
+			}
+			more = true
+		}
+		if !more {
+			return nil
+		}
+	}
+}
+
+// parsePartial parses the partial into tpl. A partial failing to parse is left out with a warning if broken partials
+// are skipped.
+func (e *engine) parsePartial(tpl *template.Template, partial string) error {
+	err := e.parse(tpl, partial)
+	if err != nil && e.skipBrokenPartials {
+		log.Printf("warning => renderlayout:partial [%s] => skipped, %v \n ", partial, err)
+		return nil
+	}
+	return err
+}
+
+// partial returns the partial referenced by ref, if it's available with the master layout.
+func (e *engine) partial(ref, master string) (string, bool) {
+	if partial, ok := e.partialAliases[ref]; ok {
+		ref = partial
+	}
+	for _, partial := range e.partials(master) {
+		if partial == ref || path.Base(partial) == ref {
+			return partial, true
+		}
+	}
+	return "", false
+}
+
+// partials returns the partials available with the master layout. A partial scoped to layouts is only available with
+// them. Without a master, e.g. for a fragment, the partials are those of the configured master layout.
+func (e *engine) partials(master string) []string {
+	if len(e.layoutPartials) == 0 {
+		return e.config.Partials
+	}
+	if master == "" {
+		master = e.config.Master
+	}
+	scoped := make(map[string]bool)
+	for _, partials := range e.layoutPartials {
+		for _, partial := range partials {
+			scoped[partial] = true
+		}
+	}
+	available := make(map[string]bool)
+	for _, partial := range e.layoutPartials[master] {
+		available[partial] = true
+	}
+
+	var partials []string
+	for _, partial := range e.config.Partials {
+		if !scoped[partial] || available[partial] {
+			partials = append(partials, partial)
+		}
+	}
+	return partials
+}
+
+// funcs returns the funcs the templates are parsed with. include is bound to the data when a template is rendered.
+func (e *engine) funcs() template.FuncMap {
+	allFuncs := make(template.FuncMap)
+	allFuncs["include"] = noInclude
+	for k, v := range e.config.Funcs {
+		allFuncs[k] = v
+	}
+	return allFuncs
+}
+
+// noInclude is the include func the templates are parsed with.
+func noInclude(string) (template.HTML, error) {
+	return "", nil
+}
@@ -0,0 +1,197 @@
+package renderlayout
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMissingKey(t *testing.T) {
+	files := map[string]string{"missing.html": `{{ define "content" }}{{ .missing }}{{ end }}`}
+	rnd := newRender(t, files)
+	if body := get(rnd("missing")).Body.String(); body != "<html></html>" {
+		t.Errorf("body is %q", body)
+	}
+
+	rnd = newRender(t, files, MissingKey("error"))
+	if body := get(rnd("missing")).Body.String(); !strings.Contains(body, "Something went wrong.") {
+		t.Errorf("body is %q, want the render error", body)
+	}
+	if _, err := New(MissingKey("strict")); err == nil {
+		t.Error("New with an invalid missingkey mode didn't fail")
+	}
+}
+
+func BenchmarkRender(b *testing.B) {
+	files := make(map[string]string)
+	layout := `<html><head><title>{{ .title }}</title></head><body>`
+	for i := 0; i < 10; i++ {
+		name := fmt.Sprintf("p%d", i)
+		layout += fmt.Sprintf(`{{ template "%s" . }}`, name)
+		files[fmt.Sprintf("partials/%s.html", name)] = fmt.Sprintf(`{{ define "%s" }}<div class="%s" title="{{ .title }}">`+
+			`<a href="/{{ .title }}?q={{ .title }}">{{ .title }}</a><script>var t = {{ .title }};</script></div>{{ end }}`,
+			name, name)
+	}
+	files["layouts/index.html"] = layout + `{{ template "content" . }}</body></html>`
+	rnd := newRender(b, files)
+	handler := rnd("home", data(D{"title": "bench", "hello": "world"}))
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	w := httptest.NewRecorder()
+	handler(w, r)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `class="p9"`) {
+		b.Fatalf("status is %d, body is %q", w.Code, w.Body.String())
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		handler(httptest.NewRecorder(), r)
+	}
+}
+
+func TestLazyPartials(t *testing.T) {
+	files := map[string]string{
+		"partials/unused.html": `{{ define "unused" }}unused{{ end }}`,
+		"home.html":            `{{ define "content" }}{{ template "main" . }}{{ end }}`,
+	}
+	for _, lazy := range []bool{false, true} {
+		loader := newCountingLoader(files)
+		rnd, err := New(Loader(loader), LazyPartials(lazy))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if body := get(rnd("home")).Body.String(); body != "<html>main</html>" {
+			t.Errorf("LazyPartials(%v) body is %q", lazy, body)
+		}
+		if n := loader.count("partials/main.html"); n != 1 {
+			t.Errorf("LazyPartials(%v): the referenced partial is compiled %d times, want 1", lazy, n)
+		}
+		want := 1
+		if lazy {
+			want = 0
+		}
+		if n := loader.count("partials/unused.html"); n != want {
+			t.Errorf("LazyPartials(%v): the unused partial is compiled %d times, want %d", lazy, n, want)
+		}
+	}
+}
+
+func TestPlaceholderFuncs(t *testing.T) {
+	files := map[string]string{"todo.html": `{{ define "content" }}{{ notYet .hello }}{{ end }}`}
+	rnd := newRender(t, files, Debug(true))
+	if w := get(rnd("todo")); w.Code != http.StatusOK || w.Body.String() != "<html>[missing func: notYet]</html>" {
+		t.Errorf("debug response is %d %q", w.Code, w.Body.String())
+	}
+	rnd = newRender(t, files)
+	if body := get(rnd("todo")).Body.String(); body != "Something went wrong." {
+		t.Errorf("body is %q, want the render error", body)
+	}
+}
+
+func TestStaticPartialCache(t *testing.T) {
+	rnd := newRender(t, map[string]string{
+		"partials/banner.html": `<b>sale</b>`,
+		"partials/greet.html":  `<i>{{ .hello }}</i>`,
+		"promo.html":           `{{ define "content" }}{{ include "partials/banner" }}{{ include "partials/greet" }}{{ end }}`,
+	})
+	handler := rnd("promo", data(D{"hello": "world"}))
+	if body := get(handler).Body.String(); body != "<html><b>sale</b><i>world</i></html>" {
+		t.Fatalf("body is %q", body)
+	}
+
+	e := rnd.renderer().engine()
+	e.tplMutex.Lock()
+	_, dynamic := e.staticMap["partials/greet"]
+	if _, ok := e.staticMap["partials/banner"]; !ok || dynamic {
+		t.Errorf("static outputs are %v, want only the banner", e.staticMap)
+	}
+	e.staticMap["partials/banner"] = "<b>cached</b>"
+	e.tplMutex.Unlock()
+	if body := get(handler).Body.String(); body != "<html><b>cached</b><i>world</i></html>" {
+		t.Errorf("body is %q, want the cached banner", body)
+	}
+}
+
+func TestViewExtension(t *testing.T) {
+	rnd := newRender(t, nil)
+	for _, view := range []string{"home", "home.html"} {
+		if w := get(rnd(view, data(D{"hello": "world"}))); w.Code != http.StatusOK || w.Body.String() != "<html>hello world</html>" {
+			t.Errorf("view %s response is %d %q", view, w.Code, w.Body.String())
+		}
+	}
+
+	// the views of the options match with or without the extension.
+	captureLog(t)
+	files := map[string]string{"layouts/index.html": `<title>{{ .layout.title }}</title>{{ template "content" . }}`}
+	for _, optionView := range []string{"home", "home.html"} {
+		rnd := newRender(t, files, StrictKeys(true), RequireKeys(optionView, "hello"), AllowedViews([]string{optionView}),
+			LayoutDataFor(map[string]Data{optionView: data(D{"title": "Home"})}))
+		for _, view := range []string{"home", "home.html"} {
+			if w := get(rnd(view, data(D{"hello": "world"}))); w.Code != http.StatusOK || w.Body.String() != "<title>Home</title>hello world" {
+				t.Errorf("view %s of the options of %s response is %d %q", view, optionView, w.Code, w.Body.String())
+			}
+			if w := get(rnd(view)); w.Code != http.StatusInternalServerError {
+				t.Errorf("view %s missing the keys of %s response is %d %q", view, optionView, w.Code, w.Body.String())
+			}
+		}
+		if w := get(rnd("about.html")); w.Code != http.StatusNotFound {
+			t.Errorf("view about.html not allowed by %s response is %d", optionView, w.Code)
+		}
+	}
+}
+
+func TestSkipBrokenPartials(t *testing.T) {
+	files := map[string]string{"partials/broken.html": `{{ define "broken" }}{{ .missing {{ end }}`}
+	logs := captureLog(t)
+	rnd := newRender(t, files, Debug(true), SkipBrokenPartials(true))
+	if w := get(rnd("home", data(D{"hello": "world"}))); w.Code != http.StatusOK || w.Body.String() != "<html>hello world</html>" {
+		t.Errorf("response is %d %q", w.Code, w.Body.String())
+	}
+	if !strings.Contains(logs.String(), "partials/broken") {
+		t.Errorf("log is %q, want the broken partial warning", logs.String())
+	}
+
+	rnd = newRender(t, files, SkipBrokenPartials(true))
+	if body := get(rnd("home", data(D{"hello": "world"}))).Body.String(); body != "Something went wrong." {
+		t.Errorf("body outside of debug mode is %q, want the render error", body)
+	}
+}
+
+func TestCaseInsensitivePaths(t *testing.T) {
+	files := map[string]string{
+		"Pages/About.html":      `{{ define "content" }}about {{ template "Banner" . }}{{ end }}`,
+		"partials/Banner.html":  `{{ define "Banner" }}banner{{ end }}`,
+		"partials/sidebar.html": `{{ define "sidebar" }}sidebar{{ end }}`,
+	}
+	rnd := newRender(t, files, CaseInsensitivePaths(true))
+	for _, view := range []string{"pages/about", "PAGES/ABOUT", "Pages/About"} {
+		if body := get(rnd(view)).Body.String(); body != "<html>about banner</html>" {
+			t.Errorf("view %s body is %q", view, body)
+		}
+	}
+	root := writeTemplates(t, files)
+	if _, err := os.Stat(filepath.Join(root, "pages", "about.html")); err == nil {
+		t.Skip("the filesystem is case insensitive")
+	}
+	captureLog(t)
+	rnd, err := New(TemplatesPath(root))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body := get(rnd("pages/about")).Body.String(); body != "Something went wrong." {
+		t.Errorf("body without the option is %q, want the render error", body)
+	}
+}
+
+func TestPartialAliases(t *testing.T) {
+	rnd := newRender(t, map[string]string{
+		"partials/user_card.html": `<div>{{ .name }}</div>`,
+		"partials/badge.html":     `<b>{{ .role }}</b>`,
+		"team.html":               `{{ define "content" }}{{ template "card" . }}{{ template "badge" . }}{{ end }}`,
+	}, PartialAliases(map[string]string{"card": "user_card", "badge": "partials/badge.html"}))
+	if body := get(rnd("team", data(D{"name": "ann", "role": "admin"}))).Body.String(); body != "<html><div>ann</div><b>admin</b></html>" {
+		t.Errorf("body is %q", body)
+	}
+}
@@ -52,6 +52,14 @@ func main() {
 				"dashboard": "dashboard",
 			}, err
 		}))
+	r.Get("/sitemap.xml", indexLayout("sitemap.xml",
+		rl.StaticData(rl.D{
+			"pages": []string{"http://localhost:3000/", "http://localhost:3000/app"},
+		})))
+	r.Get("/feed.rss", indexLayout("feed.rss",
+		rl.StaticData(rl.D{
+			"posts": []string{"hello", "world"},
+		})))
 	err = http.ListenAndServe(":3000", r)
 	if err != nil {
 		log.Fatal(err)
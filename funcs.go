@@ -0,0 +1,223 @@
+package renderlayout
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"reflect"
+	"sort"
+)
+
+// slotKey is the template variable holding the content passed to a partial by slot.
+const slotKey = "slot"
+
+// builtinFuncs are the template funcs provided by renderlayout.
+func builtinFuncs() template.FuncMap {
+	return template.FuncMap{
+		"slot":       slot,
+		"safeHTML":   safeHTML,
+		"safeURL":    safeURL,
+		"safeJS":     safeJS,
+		"safeCSS":    safeCSS,
+		"jsonData":   jsonData,
+		"flush":      func() string { return "" },
+		"sortedKeys": sortedKeys,
+		"items":      items,
+		"pageRange":  pageRange,
+		"prevPage":   prevPage,
+		"nextPage":   nextPage,
+	}
+}
+
+// safeHTML marks s as safe html, so it's rendered without escaping, e.g. {{ safeHTML .Body }}. Never use it with data
+// from users which isn't sanitized, it renders any markup or scripts in it.
+func safeHTML(s string) template.HTML {
+	return template.HTML(s)
+}
+
+// safeURL marks s as a safe URL, so it isn't filtered in attributes, e.g. a "javascript:" URL in href. Never use it
+// with URLs from users.
+func safeURL(s string) template.URL {
+	return template.URL(s)
+}
+
+// safeJS marks s as a safe JavaScript expression, so it's rendered without escaping inside <script>. Never use it with
+// data from users, it executes any code in it.
+func safeJS(s string) template.JS {
+	return template.JS(s)
+}
+
+// safeCSS marks s as safe CSS, so it isn't filtered in style attributes or <style>. Never use it with data from users.
+func safeCSS(s string) template.CSS {
+	return template.CSS(s)
+}
+
+// slot returns a copy of data with content stored under the "slot" key, so a partial can wrap content
+// provided by the caller. e.g. {{ template "card" (slot . (include "partials/card_body")) }} and {{ .slot }} inside the
+// card partial. Data which is not a map is available under the "data" key.
+func slot(data interface{}, content interface{}) D {
+	slotData := make(D)
+	switch d := data.(type) {
+	case D:
+		for k, v := range d {
+			slotData[k] = v
+		}
+	case map[string]interface{}:
+		for k, v := range d {
+			slotData[k] = v
+		}
+	default:
+		slotData["data"] = data
+	}
+	slotData[slotKey] = content
+	return slotData
+}
+
+// jsonData returns v as JSON for a data island, e.g. <script type="application/json" id="state">{{ jsonData .State }}</script>.
+// <, > and & are escaped as unicode escapes(e.g. \u003c), so a string containing "</script>" can't end the element.
+func jsonData(v interface{}) (template.JS, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	return template.JS(b), nil
+}
+
+// Item is a key and its value in a map, returned by the items func.
+type Item struct {
+	Key   string
+	Value interface{}
+}
+
+// sortedKeys returns the keys of a map with string keys, e.g. D, sorted. e.g. {{ range sortedKeys .totals }}
+func sortedKeys(m interface{}) ([]string, error) {
+	v := reflect.ValueOf(m)
+	if v.Kind() != reflect.Map || v.Type().Key().Kind() != reflect.String {
+		return nil, fmt.Errorf("sortedKeys: %T isn't a map with string keys", m)
+	}
+	keys := make([]string, 0, v.Len())
+	for _, key := range v.MapKeys() {
+		keys = append(keys, key.String())
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// items returns the keys and values of a map with string keys, e.g. D, sorted by key, to range over the map in order.
+// e.g. {{ range items .totals }}{{ .Key }}: {{ .Value }}{{ end }}
+func items(m interface{}) ([]Item, error) {
+	keys, err := sortedKeys(m)
+	if err != nil {
+		return nil, fmt.Errorf("items: %T isn't a map with string keys", m)
+	}
+	v := reflect.ValueOf(m)
+	mapItems := make([]Item, len(keys))
+	for i, key := range keys {
+		mapItems[i] = Item{Key: key, Value: v.MapIndex(reflect.ValueOf(key).Convert(v.Type().Key())).Interface()}
+	}
+	return mapItems, nil
+}
+
+// pageRange returns the page numbers to display for the current page of total pages: the current page and window pages
+// on either side, shifted at the first and last pages to show as many pages. e.g. {{ range pageRange .page .pages 2 }}
+// with page 5 of 20 is [3 4 5 6 7], and with page 1 is [1 2 3 4 5].
+func pageRange(current, total, window int) []int {
+	if total < 1 {
+		return nil
+	}
+	if window < 0 {
+		window = 0
+	}
+	current = clampPage(current, total)
+	start, end := current-window, current+window
+	if start < 1 {
+		end += 1 - start
+		start = 1
+	}
+	if end > total {
+		start -= end - total
+		end = total
+	}
+	if start < 1 {
+		start = 1
+	}
+	pages := make([]int, 0, end-start+1)
+	for page := start; page <= end; page++ {
+		pages = append(pages, page)
+	}
+	return pages
+}
+
+// prevPage returns the page before the current page, or 0 on the first page. e.g. {{ with prevPage .page }}
+func prevPage(current int) int {
+	if current <= 1 {
+		return 0
+	}
+	return current - 1
+}
+
+// nextPage returns the page after the current page of total pages, or 0 on the last page.
+// e.g. {{ with nextPage .page .pages }}
+func nextPage(current, total int) int {
+	if current >= total {
+		return 0
+	}
+	return clampPage(current, total) + 1
+}
+
+// clampPage returns the current page within the pages 1 to total.
+func clampPage(current, total int) int {
+	if current < 1 {
+		return 1
+	}
+	if current > total {
+		return total
+	}
+	return current
+}
+
+// warningFuncs wraps funcs to append a warning to warnings when they are called with a nil argument.
+func warningFuncs(funcs template.FuncMap, warnings *[]string) template.FuncMap {
+	wrapped := make(template.FuncMap, len(funcs))
+	for name, fn := range funcs {
+		wrapped[name] = warningFunc(name, fn, warnings)
+	}
+	return wrapped
+}
+
+func warningFunc(name string, fn interface{}, warnings *[]string) interface{} {
+	fnValue := reflect.ValueOf(fn)
+	fnType := fnValue.Type()
+	if fnType.Kind() != reflect.Func {
+		return fn
+	}
+	return reflect.MakeFunc(fnType, func(args []reflect.Value) []reflect.Value {
+		for i, arg := range args {
+			if fnType.IsVariadic() && i == len(args)-1 {
+				for j := 0; j < arg.Len(); j++ {
+					if isNil(arg.Index(j)) {
+						*warnings = append(*warnings, fmt.Sprintf("func %s called with nil argument %d", name, i+j+1))
+					}
+				}
+				continue
+			}
+			if isNil(arg) {
+				*warnings = append(*warnings, fmt.Sprintf("func %s called with nil argument %d", name, i+1))
+			}
+		}
+		if fnType.IsVariadic() {
+			return fnValue.CallSlice(args)
+		}
+		return fnValue.Call(args)
+	}).Interface()
+}
+
+func isNil(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Invalid:
+		return true
+	case reflect.Chan, reflect.Func, reflect.Interface, reflect.Map, reflect.Ptr, reflect.Slice:
+		return v.IsNil()
+	}
+	return false
+}
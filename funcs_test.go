@@ -0,0 +1,111 @@
+package renderlayout
+
+import (
+	"fmt"
+	"html/template"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSlot(t *testing.T) {
+	rnd := newRender(t, map[string]string{
+		"partials/card.html":      `{{ define "card" }}<div class="card">{{ .title }}: {{ .slot }}</div>{{ end }}`,
+		"partials/card_body.html": `<p>body</p>`,
+		"card.html": `{{ define "content" }}{{ template "card" (slot . "inner") }}` +
+			`{{ template "card" (slot . (include "partials/card_body")) }}{{ end }}`,
+	})
+	want := `<html><div class="card">cards: inner</div><div class="card">cards: <p>body</p></div></html>`
+	if body := get(rnd("card", data(D{"title": "cards"}))).Body.String(); body != want {
+		t.Errorf("body is %q, want %q", body, want)
+	}
+}
+
+func TestWarningFuncs(t *testing.T) {
+	logs := captureLog(t)
+	rnd := newRender(t, map[string]string{"show.html": `{{ define "content" }}{{ show .missing }}{{ show .hello }}{{ end }}`},
+		Debug(true),
+		AddFuncs(template.FuncMap{"show": func(v interface{}) string { return fmt.Sprint(v) }}))
+	if body := get(rnd("show", data(D{"hello": "world"}))).Body.String(); body != "<html>&lt;nil&gt;world</html>" {
+		t.Errorf("body is %q", body)
+	}
+	if n := strings.Count(logs.String(), "func show called with nil argument 1"); n != 1 {
+		t.Errorf("the nil argument warning is logged %d times, want 1: %s", n, logs)
+	}
+
+	var warnings []string
+	join := warningFuncs(template.FuncMap{"join": strings.Join}, &warnings)["join"].(func([]string, string) string)
+	if got := join(nil, ","); got != "" || len(warnings) != 1 {
+		t.Errorf("join is %q with warnings %q", got, warnings)
+	}
+}
+
+func TestSafeFuncs(t *testing.T) {
+	rnd := newRender(t, map[string]string{
+		"safe.html": `{{ define "content" }}{{ .raw }}|{{ safeHTML .raw }}|<a href="{{ .url }}"></a><a href="{{ safeURL .url }}"></a>` +
+			`<script>var x = {{ safeJS .js }};</script><p style="{{ safeCSS .css }}"></p>{{ end }}`,
+	})
+	body := get(rnd("safe", data(D{"raw": "<b>bold</b>", "url": "javascript:go()", "js": "1 + 2", "css": "color: red"}))).Body.String()
+	want := `<html>&lt;b&gt;bold&lt;/b&gt;|<b>bold</b>|<a href="#ZgotmplZ"></a><a href="javascript:go%28%29"></a>` +
+		`<script>var x = 1 + 2;</script><p style="color: red"></p></html>`
+	if body != want {
+		t.Errorf("body is %q, want %q", body, want)
+	}
+}
+
+func TestJSONData(t *testing.T) {
+	rnd := newRender(t, map[string]string{
+		"island.html": `{{ define "content" }}<script type="application/json" id="state">{{ jsonData .state }}</script>{{ end }}`,
+	})
+	body := get(rnd("island", data(D{"state": D{"bio": "</script><script>alert(1)</script>", "n": 1}}))).Body.String()
+	want := `<html><script type="application/json" id="state">{"bio":"\u003c/script\u003e\u003cscript\u003ealert(1)\u003c/script\u003e","n":1}</script></html>`
+	if body != want {
+		t.Errorf("body is %q, want %q", body, want)
+	}
+	if _, err := jsonData(func() {}); err == nil {
+		t.Error("jsonData of a func succeeds")
+	}
+}
+
+func TestItems(t *testing.T) {
+	rnd := newRender(t, map[string]string{
+		"totals.html": `{{ define "content" }}{{ range items .totals }}{{ .Key }}={{ .Value }};{{ end }}` +
+			`{{ range sortedKeys .totals }}{{ . }};{{ end }}{{ end }}`,
+	})
+	totals := map[string]int{"pears": 3, "apples": 1, "figs": 2, "bananas": 5}
+	if body := get(rnd("totals", data(D{"totals": totals}))).Body.String(); body != "<html>apples=1;bananas=5;figs=2;pears=3;apples;bananas;figs;pears;</html>" {
+		t.Errorf("body is %q", body)
+	}
+	if _, err := items([]string{"a"}); err == nil {
+		t.Error("items of a slice succeeds")
+	}
+}
+
+func TestPagination(t *testing.T) {
+	for _, tc := range []struct {
+		current, total, window int
+		want                   []int
+	}{
+		{5, 20, 2, []int{3, 4, 5, 6, 7}},
+		{1, 20, 2, []int{1, 2, 3, 4, 5}},
+		{20, 20, 2, []int{16, 17, 18, 19, 20}},
+		{2, 3, 2, []int{1, 2, 3}},
+		{9, 3, 1, []int{1, 2, 3}},
+		{1, 0, 2, nil},
+	} {
+		if got := pageRange(tc.current, tc.total, tc.window); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("pageRange(%d, %d, %d) is %v, want %v", tc.current, tc.total, tc.window, got, tc.want)
+		}
+	}
+	if prevPage(1) != 0 || prevPage(5) != 4 || nextPage(20, 20) != 0 || nextPage(5, 20) != 6 || nextPage(0, 20) != 2 {
+		t.Error("prevPage or nextPage is wrong")
+	}
+
+	rnd := newRender(t, map[string]string{
+		"list.html": `{{ define "content" }}{{ with prevPage .page }}prev {{ . }}{{ end }}{{ range pageRange .page .pages 2 }} {{ . }}{{ end }}` +
+			` {{ with nextPage .page .pages }}next {{ . }}{{ end }}{{ end }}`,
+	})
+	if body := get(rnd("list", data(D{"page": 5, "pages": 20}))).Body.String(); body != "<html>prev 4 3 4 5 6 7 next 6</html>" {
+		t.Errorf("body is %q", body)
+	}
+}
@@ -1,14 +1,16 @@
 module github.com/adnaan/renderlayout
 
-go 1.15
+go 1.16
 
 require (
 	github.com/Masterminds/goutils v1.1.1 // indirect
 	github.com/Masterminds/semver v1.5.0 // indirect
 	github.com/Masterminds/sprig v2.22.0+incompatible
+	github.com/andybalholm/brotli v1.0.4
 	github.com/foolin/goview v0.3.0
 	github.com/go-chi/chi v1.5.1
-	github.com/google/uuid v1.2.0 // indirect
+	github.com/google/uuid v1.2.0
+	github.com/gorilla/sessions v1.2.1
 	github.com/huandu/xstrings v1.3.2 // indirect
 	github.com/imdario/mergo v0.3.11 // indirect
 	github.com/mitchellh/copystructure v1.1.1 // indirect
@@ -0,0 +1,63 @@
+package renderlayout
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"sort"
+)
+
+// TemplateLoader loads the templates instead of the templates path, e.g. from a database.
+type TemplateLoader interface {
+	// Load returns the template file with the name, e.g. "home.html" or "partials/header.html".
+	Load(name string) ([]byte, error)
+	// List returns the names of the files in the directory, e.g. "header.html" in "partials".
+	List(dir string) ([]string, error)
+}
+
+// layeredLoader loads the templates from the first of the layers which has them.
+type layeredLoader []fs.FS
+
+// Load reads the file from the first of the layers which has it.
+func (layers layeredLoader) Load(name string) ([]byte, error) {
+	for _, layer := range layers {
+		data, err := fs.ReadFile(layer, name)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		return data, err
+	}
+	return nil, fmt.Errorf("open %s: %w", name, fs.ErrNotExist)
+}
+
+// List returns the names of the files in the directory of any of the layers, sorted. It fails if none of the layers
+// has the directory.
+func (layers layeredLoader) List(dir string) ([]string, error) {
+	found := false
+	names := make(map[string]bool)
+	for _, layer := range layers {
+		entries, err := fs.ReadDir(layer, dir)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		found = true
+		for _, entry := range entries {
+			if !entry.IsDir() {
+				names[entry.Name()] = true
+			}
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("open %s: %w", dir, fs.ErrNotExist)
+	}
+
+	var files []string
+	for name := range names {
+		files = append(files, name)
+	}
+	sort.Strings(files)
+	return files, nil
+}
@@ -0,0 +1,69 @@
+package renderlayout
+
+import (
+	"errors"
+	"io/fs"
+	"reflect"
+	"testing"
+	"testing/fstest"
+)
+
+func TestLayeredFS(t *testing.T) {
+	base := fstest.MapFS{
+		"layouts/index.html":   {Data: []byte(`<html>{{ template "header" . }}{{ template "content" . }}</html>`)},
+		"partials/header.html": {Data: []byte(`{{ define "header" }}base header {{ end }}`)},
+		"partials/footer.html": {Data: []byte(`{{ define "footer" }}base footer{{ end }}`)},
+		"home.html":            {Data: []byte(`{{ define "content" }}{{ template "footer" . }}{{ end }}`)},
+	}
+	theme := fstest.MapFS{
+		"partials/header.html": {Data: []byte(`{{ define "header" }}theme header {{ end }}`)},
+		"partials/theme.html":  {Data: []byte(`{{ define "theme" }}theme{{ end }}`)},
+	}
+
+	loader := layeredLoader{theme, base}
+	names, err := loader.List("partials")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"footer.html", "header.html", "theme.html"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("partials are %v, want %v", names, want)
+	}
+	if _, err := loader.List("missing"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("List of a missing directory error is %v", err)
+	}
+	if _, err := loader.Load("missing.html"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Load of a missing file error is %v", err)
+	}
+
+	rnd, err := New(LayeredFS(theme, base))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body := get(rnd("home")).Body.String(); body != "<html>theme header base footer</html>" {
+		t.Errorf("body is %q", body)
+	}
+}
+
+func TestLoader(t *testing.T) {
+	loader := newCountingLoader(map[string]string{
+		"layouts/index.html":   `<html>{{ template "header" . }}{{ template "content" . }}</html>`,
+		"partials/header.html": `{{ define "header" }}header {{ end }}`,
+		"pages/about.html":     `{{ define "content" }}about {{ .hello }}{{ end }}`,
+	})
+	rnd, err := New(Loader(loader))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body := get(rnd("pages/about", data(D{"hello": "us"}))).Body.String(); body != "<html>header about us</html>" {
+		t.Errorf("body is %q", body)
+	}
+	for _, name := range []string{"layouts/index.html", "partials/header.html", "pages/about.html"} {
+		if n := loader.count(name); n != 1 {
+			t.Errorf("%s is loaded %d times, want 1", name, n)
+		}
+	}
+	captureLog(t)
+	if body := get(rnd("pages/missing")).Body.String(); body != "Something went wrong." {
+		t.Errorf("missing view body is %q", body)
+	}
+}
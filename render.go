@@ -1,18 +1,35 @@
 package renderlayout
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"html/template"
+	"io"
+	"io/fs"
 	"io/ioutil"
 	"log"
+	"mime"
 	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 	"unicode"
 
 	"github.com/Masterminds/sprig"
+	"github.com/andybalholm/brotli"
 	"github.com/foolin/goview"
+	"github.com/google/uuid"
 )
 
 type D map[string]interface{}
@@ -21,15 +38,432 @@ type Data func(w http.ResponseWriter, r *http.Request) (D, error)
 
 type Render func(view string, dataFuncs ...Data) http.HandlerFunc
 
+// StaticData returns the data for every request. Every request gets a copy of d, so the keys set or deleted in the view
+// data of one request don't leak into the others. The values are shared, see StaticDataImmutable.
 func StaticData(d D) Data {
 	return func(_ http.ResponseWriter, _ *http.Request) (D, error) {
-		return d, nil
+		c := make(D, len(d))
+		for k, v := range d {
+			c[k] = v
+		}
+		return c, nil
+	}
+}
+
+// StaticDataImmutable returns the data for every request like StaticData, but every request gets a deep copy of the
+// maps and slices in d, e.g. D{"nav": []D{{"title": "Home"}}}, so changes to them don't leak into the other requests
+// either. Other values, e.g. structs and pointers, are shared by the requests.
+func StaticDataImmutable(d D) Data {
+	return func(_ http.ResponseWriter, _ *http.Request) (D, error) {
+		return copyValue(reflect.ValueOf(d)).Interface().(D), nil
+	}
+}
+
+// copyValue returns v with its maps and slices copied, recursively.
+func copyValue(v reflect.Value) reflect.Value {
+	switch v.Kind() {
+	case reflect.Interface:
+		if v.IsNil() {
+			return v
+		}
+		return copyValue(v.Elem())
+	case reflect.Map:
+		if v.IsNil() {
+			return v
+		}
+		c := reflect.MakeMapWithSize(v.Type(), v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			c.SetMapIndex(iter.Key(), copyValue(iter.Value()))
+		}
+		return c
+	case reflect.Slice:
+		if v.IsNil() {
+			return v
+		}
+		c := reflect.MakeSlice(v.Type(), v.Len(), v.Len())
+		for i := 0; i < v.Len(); i++ {
+			c.Index(i).Set(copyValue(v.Index(i)))
+		}
+		return c
+	}
+	return v
+}
+
+// FieldError is a user error about a field, e.g. a form validation error. See StructuredErrors.
+type FieldError interface {
+	error
+	Field() string
+	Code() string
+}
+
+// ViewError is the template view of a FieldError shown to the user, e.g. {{ .Field }} and {{ .Message }}. It isn't an
+// error itself. See StructuredErrors.
+type ViewError struct {
+	Code    string
+	Field   string
+	Message string
+}
+
+// contextKey is the view data key of the context returned by a ContextData func.
+const contextKey = "_context"
+
+// ContextData is a Data func which also returns a context, e.g. with a typed value it computed for the data funcs
+// after it. It's used with WithContext.
+type ContextData func(w http.ResponseWriter, r *http.Request) (D, context.Context, error)
+
+// WithContext returns the Data func of dataFunc, e.g. for DefaultData. The context it returns, unless it's nil, is
+// installed on the request passed to the data funcs after it, e.g. to share the authenticated user with the views'
+// data funcs:
+//
+//	rl.DefaultData(rl.WithContext(func(w http.ResponseWriter, r *http.Request) (rl.D, context.Context, error) {
+//		user := currentUser(r)
+//		return rl.D{"user": user.Name}, context.WithValue(r.Context(), userKey, user), nil
+//	}))
+func WithContext(dataFunc ContextData) Data {
+	return func(w http.ResponseWriter, r *http.Request) (D, error) {
+		data, ctx, err := dataFunc(w, r)
+		if ctx == nil {
+			return data, err
+		}
+		if data == nil {
+			data = make(D)
+		}
+		data[contextKey] = ctx
+		return data, err
+	}
+}
+
+// dataContext returns the request with the context returned by a WithContext data func in data, if any.
+func dataContext(r *http.Request, data D) *http.Request {
+	if ctx, ok := data[contextKey].(context.Context); ok {
+		return r.WithContext(ctx)
+	}
+	return r
+}
+
+// Combine returns a Data func running the data funcs in order. Their view data is merged, later data funcs overwrite
+// the keys of earlier ones, and their errors are all returned, to be handled the same way as if they were separate.
+func Combine(dataFuncs ...Data) Data {
+	return func(w http.ResponseWriter, r *http.Request) (D, error) {
+		combined := make(D)
+		var errs dataErrors
+		for _, dataFunc := range dataFuncs {
+			data, err := dataFunc(w, r)
+			if err != nil {
+				errs = append(errs, err)
+			}
+			mergeData(combined, data)
+			r = dataContext(r, data)
+		}
+		switch len(errs) {
+		case 0:
+			return combined, nil
+		case 1:
+			return combined, errs[0]
+		}
+		return combined, errs
+	}
+}
+
+// responder is an error returned by a data func to respond to the request instead of rendering the view.
+type responder interface {
+	error
+	respond(w http.ResponseWriter)
+}
+
+// responded responds to the request if err is a responder, and reports whether it did.
+func responded(w http.ResponseWriter, err error) bool {
+	for _, err := range splitErrors(err) {
+		var resp responder
+		if errors.As(err, &resp) {
+			resp.respond(w)
+			return true
+		}
+	}
+	return false
+}
+
+// NoContent returns the error a data func returns to respond with 204 No Content instead of rendering the view.
+func NoContent() error {
+	return noContent{}
+}
+
+type noContent struct{}
+
+func (noContent) Error() string {
+	return "renderlayout: no content"
+}
+
+func (noContent) respond(w http.ResponseWriter) {
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// RawResponse returns the error a data func returns to respond with the body as is, instead of rendering the view, e.g.
+// a cached page.
+func RawResponse(contentType string, body []byte) error {
+	return rawResponse{contentType: contentType, body: body}
+}
+
+type rawResponse struct {
+	contentType string
+	body        []byte
+}
+
+func (rawResponse) Error() string {
+	return "renderlayout: raw response"
+}
+
+func (resp rawResponse) respond(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", resp.contentType)
+	w.WriteHeader(http.StatusOK)
+	w.Write(resp.body)
+}
+
+// Download returns the error a data func returns to respond with the body as a file download instead of rendering the
+// view, e.g. a generated CSV. The body is copied to the response, and closed if it's an io.Closer.
+func Download(filename, contentType string, body io.Reader) error {
+	return download{filename: filename, contentType: contentType, body: body}
+}
+
+type download struct {
+	filename    string
+	contentType string
+	body        io.Reader
+}
+
+func (download) Error() string {
+	return "renderlayout: download"
+}
+
+func (resp download) respond(w http.ResponseWriter) {
+	if closer, ok := resp.body.(io.Closer); ok {
+		defer closer.Close()
+	}
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": resp.filename}))
+	w.Header().Set("Content-Type", resp.contentType)
+	w.WriteHeader(http.StatusOK)
+	io.Copy(w, resp.body)
+}
+
+// cacheKey is the view data key of the CacheControl directives of the response.
+const cacheKey = "_cache"
+
+// CacheControl are the Cache-Control directives of a response, set by a data func with the "_cache" key, e.g.
+// D{"_cache": CacheControl{MaxAge: 60, Public: true}}. The header is set before rendering, and the key is removed from
+// the view data. Without the key, no Cache-Control header is set. A response with the header is rendered into a buffer,
+// so a failed render is a 500 with the RenderError and without the header, instead of a cached error page.
+type CacheControl struct {
+	// MaxAge is the max-age in seconds. It's set if it's positive, or with NoStore.
+	MaxAge         int
+	Public         bool
+	Private        bool
+	NoCache        bool
+	NoStore        bool
+	MustRevalidate bool
+}
+
+// String returns the value of the Cache-Control header.
+func (c CacheControl) String() string {
+	var directives []string
+	if c.Public {
+		directives = append(directives, "public")
+	}
+	if c.Private {
+		directives = append(directives, "private")
+	}
+	if c.NoCache {
+		directives = append(directives, "no-cache")
+	}
+	if c.NoStore {
+		directives = append(directives, "no-store")
+	}
+	if c.MaxAge > 0 || c.NoStore {
+		directives = append(directives, fmt.Sprintf("max-age=%d", c.MaxAge))
+	}
+	if c.MustRevalidate {
+		directives = append(directives, "must-revalidate")
+	}
+	return strings.Join(directives, ", ")
+}
+
+// Private returns the Data func of a page showing private data, e.g. rnd("account", rl.Private(), accountData), which
+// sets "Cache-Control: no-store, max-age=0" so no cache stores the response. A later data func setting the "_cache"
+// key overrides it.
+func Private() Data {
+	return func(w http.ResponseWriter, r *http.Request) (D, error) {
+		return D{cacheKey: CacheControl{NoStore: true}}, nil
+	}
+}
+
+// setCacheControl sets the Cache-Control header from the CacheControl in the view data, and removes it.
+func setCacheControl(w http.ResponseWriter, data D) {
+	var cacheControl CacheControl
+	switch c := data[cacheKey].(type) {
+	case CacheControl:
+		cacheControl = c
+	case *CacheControl:
+		if c == nil {
+			return
+		}
+		cacheControl = *c
+	default:
+		return
+	}
+	delete(data, cacheKey)
+	if value := cacheControl.String(); value != "" {
+		w.Header().Set("Cache-Control", value)
+	}
+}
+
+// surrogateKeysKey is the view data key of the surrogate keys of the response.
+const surrogateKeysKey = "_surrogate_keys"
+
+// setSurrogateKeys sets the Surrogate-Key header from the surrogate keys in the view data, set by data funcs with the
+// "_surrogate_keys" key, e.g. D{"_surrogate_keys": []string{"product-42"}}, for a CDN to purge the pages built from
+// the content. The keys of the data funcs are merged, and removed from the view data. Like the Cache-Control header,
+// the header is dropped when the render fails.
+func setSurrogateKeys(w http.ResponseWriter, data D) {
+	keys, _ := data[surrogateKeysKey].([]string)
+	delete(data, surrogateKeysKey)
+	if len(keys) == 0 {
+		return
+	}
+	seen := make(map[string]bool, len(keys))
+	unique := make([]string, 0, len(keys))
+	for _, key := range keys {
+		if !seen[key] {
+			seen[key] = true
+			unique = append(unique, key)
+		}
+	}
+	w.Header().Set("Surrogate-Key", strings.Join(unique, " "))
+}
+
+// contentTypeKey is the view data key of the content type of the response.
+const contentTypeKey = "_content_type"
+
+// ContentTypeFor returns the Data func setting the content type of the view, instead of the content type for the
+// view's extension, e.g. rnd("robots", rl.ContentTypeFor("text/plain")).
+func ContentTypeFor(contentType string) Data {
+	return func(w http.ResponseWriter, r *http.Request) (D, error) {
+		return D{contentTypeKey: contentType}, nil
+	}
+}
+
+// funcsKey is the view data key of the template funcs of a render.
+const funcsKey = "_funcs"
+
+// WithFuncs returns the Data func adding template funcs to the render, overlaying the global funcs, e.g. a formatter
+// only used by one route: rnd("report", rl.WithFuncs(template.FuncMap{"quarter": quarter}), reportData). A view
+// calling a func which isn't added to its render fails to render. The funcs of WithFuncs data funcs are merged.
+func WithFuncs(funcs template.FuncMap) Data {
+	return func(w http.ResponseWriter, r *http.Request) (D, error) {
+		return D{funcsKey: funcs}, nil
+	}
+}
+
+// layoutKey is the template variable name containing the layout data.
+const layoutKey = "layout"
+
+// controlKeys are the view data keys read by the renderer instead of the templates, e.g. the "_cache" key.
+var controlKeys = []string{contextKey, cacheKey, surrogateKeysKey, contentTypeKey, funcsKey, flashKey}
+
+// FlashStore saves flash messages for the next request of the client, e.g. in its session, for the post/redirect/get
+// pattern. session.FlashStore is the FlashStore of a gorilla/sessions store.
+type FlashStore interface {
+	// SetFlash adds the flash message for the next request.
+	SetFlash(w http.ResponseWriter, r *http.Request, msg string) error
+}
+
+// flashKey is the view data key of the flash messages a data func sets for the next request.
+const flashKey = "_flash"
+
+// LayoutData returns a Data func running the data funcs like Combine, with their view data under the "layout" key.
+// It's for the data of the layout, e.g. navigation, as opposed to the view's content: {{.layout.nav}}
+// The layout data of all data funcs is merged. The keys read by the renderer, e.g. "_cache" or a WithContext context,
+// stay at the top level, so they apply like the keys of the view's data funcs.
+func LayoutData(dataFuncs ...Data) Data {
+	combined := Combine(dataFuncs...)
+	return func(w http.ResponseWriter, r *http.Request) (D, error) {
+		data, err := combined(w, r)
+		layoutData := D{layoutKey: data}
+		for _, key := range controlKeys {
+			if v, ok := data[key]; ok {
+				delete(data, key)
+				layoutData[key] = v
+			}
+		}
+		return layoutData, err
+	}
+}
+
+// mergeData merges data into viewData. Keys are overwritten, except the layout data, which is merged.
+func mergeData(viewData, data D) {
+	for k, v := range data {
+		if keys, ok := v.([]string); ok && k == surrogateKeysKey {
+			existing, _ := viewData[k].([]string)
+			viewData[k] = append(append([]string(nil), existing...), keys...)
+			continue
+		}
+		if funcs, ok := v.(template.FuncMap); ok && k == funcsKey {
+			merged := make(template.FuncMap)
+			existing, _ := viewData[k].(template.FuncMap)
+			for name, fn := range existing {
+				merged[name] = fn
+			}
+			for name, fn := range funcs {
+				merged[name] = fn
+			}
+			viewData[k] = merged
+			continue
+		}
+		layout, ok := v.(D)
+		existing, exists := viewData[k].(D)
+		if k != layoutKey || !ok || !exists {
+			viewData[k] = v
+			continue
+		}
+		merged := make(D, len(existing)+len(layout))
+		for lk, lv := range existing {
+			merged[lk] = lv
+		}
+		for lk, lv := range layout {
+			merged[lk] = lv
+		}
+		viewData[k] = merged
+	}
+}
+
+// dataErrors are the errors returned by the data funcs of Combine, or by the views of RenderAll.
+type dataErrors []error
+
+func (e dataErrors) Error() string {
+	errStrings := make([]string, len(e))
+	for i, err := range e {
+		errStrings[i] = err.Error()
+	}
+	return strings.Join(errStrings, "; ")
+}
+
+// splitErrors returns the errors combined in err.
+func splitErrors(err error) []error {
+	errs, ok := err.(dataErrors)
+	if !ok {
+		return []error{err}
+	}
+	var split []error
+	for _, err := range errs {
+		split = append(split, splitErrors(err)...)
 	}
+	return split
 }
 
 type Option func(renderer *renderer)
 
 // Debug enables verbose logging. Prints the data being rendered in the template. Default is false
+// Template funcs called with a nil argument are logged as warnings after the render.
+// Calls to undefined template funcs render a placeholder, e.g. [missing func: name], instead of failing the render.
 func Debug(enable bool) Option {
 	return func(renderer *renderer) {
 		renderer.debug = enable
@@ -37,7 +471,8 @@ func Debug(enable bool) Option {
 }
 
 // DefaultData is the function called everytime before a template is rendered. Default is nil
-// This can be used to set template variables needed in every template.
+// This can be used to set template variables needed in every template. A nil map without an error is no data, unless
+// RequireDefaultData is set.
 func DefaultData(data Data) Option {
 	return func(renderer *renderer) {
 		renderer.defaultData = data
@@ -46,6 +481,7 @@ func DefaultData(data Data) Option {
 
 // ErrorKey changes the template variable name containing view errors. Default value is "errors"
 // errors.Unwrap is used to find the error to be shown to the user, otherwise it's only logged.
+// User errors are plain strings, so html/template escapes them like any other value when they are rendered.
 func ErrorKey(key string) Option {
 	return func(renderer *renderer) {
 		renderer.errorKey = key
@@ -67,6 +503,26 @@ func LayoutsPath(layouts string) Option {
 	}
 }
 
+// LayoutsRoot sets the directory containing the layouts, independent of the templates path. Default is empty
+// When set, the layout is searched within it instead of the templates layouts path. e.g. "shared/layouts/index.html"
+func LayoutsRoot(layoutsRoot string) Option {
+	return func(renderer *renderer) {
+		renderer.layoutsRoot = layoutsRoot
+	}
+}
+
+// ViewsPath sets the path to the views. Default is empty, the views are searched within the templates path.
+// The path is searched within the templates path, e.g. with "pages" the view "home" is "templates/pages/home.html".
+// Views outside the path, e.g. "../partials/main", can't be rendered.
+func ViewsPath(viewsPath string) Option {
+	return func(renderer *renderer) {
+		renderer.viewsPath = path.Clean(strings.Trim(viewsPath, "/"))
+		if renderer.viewsPath == "." {
+			renderer.viewsPath = ""
+		}
+	}
+}
+
 // PartialsPath sets the path to main template to be used. Default value is "partials"
 // The path is searched within the templates path. e.g. "templates/partials"
 func PartialsPath(partials string) Option {
@@ -84,8 +540,13 @@ func Layout(layout string) Option {
 }
 
 // Extension sets the file extension for templates and partials. Default value is html
+// A leading dot is optional, "html" and ".html" are equivalent. An empty extension keeps the default.
 func Extension(extension string) Option {
 	return func(renderer *renderer) {
+		extension = strings.TrimPrefix(extension, ".")
+		if extension == "" {
+			return
+		}
 		renderer.extension = fmt.Sprintf(".%s", extension)
 	}
 }
@@ -108,10 +569,47 @@ func Delimiters(left, right string) Option {
 }
 
 // AddFuncs adds additional templates funcs. Default is nil
-// github.com/Masterminds/sprig is already configured.
+// github.com/Masterminds/sprig and the renderlayout funcs(e.g. slot) are already configured. A func named like a
+// renderlayout func replaces it.
 func AddFuncs(funcMap template.FuncMap) Option {
 	return func(renderer *renderer) {
-		renderer.funcs = funcMap
+		renderer.addFuncs("", funcMap)
+	}
+}
+
+// AddNamespacedFuncs adds additional template funcs named with the prefix, so funcs from different func maps don't clobber
+// each other. e.g. the func "format" with the prefix "billing" is called as {{ billing_format .Amount }}. Default is nil
+func AddNamespacedFuncs(prefix string, funcMap template.FuncMap) Option {
+	return func(renderer *renderer) {
+		renderer.addFuncs(strings.TrimSuffix(prefix, "_")+"_", funcMap)
+	}
+}
+
+// AddDynamicFuncs adds template funcs returned by funcs for every render, e.g. funcs depending on feature flags which
+// change at runtime. funcs is called once by New for the func names the templates can call, so a func can change between
+// renders but not be added. Default is nil
+func AddDynamicFuncs(funcs func() template.FuncMap) Option {
+	return func(renderer *renderer) {
+		renderer.dynamicFuncs = append(renderer.dynamicFuncs, funcs)
+	}
+}
+
+// ReplaceFuncs sets the template funcs to exactly funcs, instead of sprig's and the built-in funcs, e.g. with only the
+// app's own funcs. AddFuncs, AddNamespacedFuncs and AddDynamicFuncs are ignored. The funcs of options like Manifest,
+// and the flush func of Streaming, are still added. Default is nil
+func ReplaceFuncs(funcs template.FuncMap) Option {
+	return func(renderer *renderer) {
+		renderer.replacedFuncs = funcs
+		renderer.replaceFuncs = true
+	}
+}
+
+// Environment sets the environment the app runs in, e.g. "development". Outside of "production", a failed render shows
+// the error and the view data after the RenderError, for developers. Never use it in production, the details may
+// contain private data. Default is "production", only the RenderError is shown
+func Environment(env string) Option {
+	return func(renderer *renderer) {
+		renderer.environment = env
 	}
 }
 
@@ -122,152 +620,2507 @@ func RenderError(error string) Option {
 	}
 }
 
-func New(opts ...Option) (Render, error) {
+// BeforeRender adds a hook called with the final view data, after all data funcs have run and just before
+// the template is rendered. The returned data is rendered. Hooks run in the order they were added. Default is nil
+func BeforeRender(hook func(r *http.Request, data D) D) Option {
+	return func(renderer *renderer) {
+		renderer.beforeRender = append(renderer.beforeRender, hook)
+	}
+}
 
-	lr := &renderer{
-		root:         "templates",
-		partials:     "partials",
-		errorKey:     "errors",
-		layout:       "index",
-		layouts:      "layouts",
-		extension:    ".html",
-		renderError:  "Something went wrong.",
-		disableCache: false,
-		debug:        false,
-		delims: goview.Delims{
-			Left:  "{{",
-			Right: "}}",
-		},
+// AfterRender adds a hook called with the rendered response body. The returned bytes are written to the response.
+// Setting a hook renders views into a buffer before writing them out. Hooks run in the order they were added. Default is nil
+func AfterRender(hook func(r *http.Request, body []byte) []byte) Option {
+	return func(renderer *renderer) {
+		renderer.afterRender = append(renderer.afterRender, hook)
 	}
+}
 
-	for _, opt := range opts {
-		opt(lr)
+// RawErrors shows user errors verbatim. Default is false
+// By default user errors are lower cased and their first letter is capitalized. Verbatim errors are still escaped when rendered.
+func RawErrors(enable bool) Option {
+	return func(renderer *renderer) {
+		renderer.rawErrors = enable
 	}
+}
 
-	allFuncs := make(template.FuncMap)
-	for k, v := range lr.funcs {
-		allFuncs[k] = v
+// MissingKey sets the behavior when a template references a key missing from the view data. Default value is "default"
+// Valid values are "default", "invalid", "zero" and "error", with the same meaning as the html/template option "missingkey".
+// "error" fails the render instead of printing "<no value>".
+func MissingKey(mode string) Option {
+	return func(renderer *renderer) {
+		renderer.missingKey = mode
 	}
+}
 
-	for k, v := range sprig.FuncMap() {
-		allFuncs[k] = v
+// HTMXAware renders views without the layout for htmx requests. Default is false
+// A request with the HX-Request header, which isn't boosted(HX-Boosted), is an htmx request. The view's "content" block is
+// rendered if it defines one, otherwise the whole view.
+func HTMXAware(enable bool) Option {
+	return func(renderer *renderer) {
+		renderer.htmxAware = enable
 	}
+}
 
-	lr.funcs = allFuncs
+// FragmentWhen renders views without the layout for the requests matching when, like htmx requests with HTMXAware,
+// e.g. an embeddable widget requested with ?embed=1:
+//
+//	rl.FragmentWhen(func(r *http.Request) bool { return r.URL.Query().Get("embed") == "1" })
+//
+// Default is nil
+func FragmentWhen(when func(r *http.Request) bool) Option {
+	return func(renderer *renderer) {
+		renderer.fragmentWhen = when
+	}
+}
 
-	fileInfo, err := ioutil.ReadDir(fmt.Sprintf("%s/%s", lr.root, lr.partials))
-	if err != nil {
-		return nil, err
+// LayoutDataFor sets the layout data func of views, by the view name, e.g. {"settings": settingsTitle}. It runs before
+// the view's data funcs, like LayoutData, so its view data is under the "layout" key: {{.layout.title}}
+// Default is nil
+func LayoutDataFor(dataFuncs map[string]Data) Option {
+	return func(renderer *renderer) {
+		renderer.layoutDataFor = dataFuncs
 	}
-	var partials []string
-	for _, file := range fileInfo {
-		if !strings.HasSuffix(file.Name(), lr.extension) {
-			continue
-		}
-		partials = append(partials, fmt.Sprintf("%s/%s",
-			lr.partials,
-			strings.TrimSuffix(file.Name(), lr.extension)))
+}
+
+// FailOnDefaultDataError aborts the render with a 500 and the RenderError when DefaultData returns an error.
+// Default is false, the view is rendered with the error.
+func FailOnDefaultDataError(enable bool) Option {
+	return func(renderer *renderer) {
+		renderer.failOnDefaultDataError = enable
 	}
+}
 
-	viewEngine := goview.New(goview.Config{
-		Root:         lr.root,
-		Extension:    lr.extension,
-		Master:       fmt.Sprintf("%s/%s", lr.layouts, lr.layout),
-		Partials:     partials,
-		DisableCache: lr.disableCache,
-		Funcs:        lr.funcs, // http://masterminds.github.io/sprig/
-	})
+// RequireDefaultData aborts the render with a 500 and the RenderError when DefaultData returns a nil map without an
+// error, e.g. a misconfigured provider. Default is false, the view is rendered without default data.
+func RequireDefaultData(enable bool) Option {
+	return func(renderer *renderer) {
+		renderer.requireDefaultData = enable
+	}
+}
 
-	lr.viewEngine = viewEngine
-	return func(view string, dataFuncs ...Data) http.HandlerFunc {
-		return func(w http.ResponseWriter, r *http.Request) {
-			viewData := make(map[string]interface{})
-			var errStrings []string
-			if lr.defaultData != nil {
-				defaultData, err := lr.defaultData(w, r)
-				if err != nil {
-					// a wrapped error is shown to the user.
-					viewError := errors.Unwrap(err)
-					if viewError != nil {
-						errStrings = append(errStrings, first(strings.ToLower(viewError.Error())))
-						log.Printf("user:renderlayout:defaultData => %v \n ", err)
-					} else {
-						log.Printf("internal: renderlayout:defaultData => %v \n ", err)
-					}
-				}
+// FailOnViewDataError aborts the render with a 500 and the RenderError when a view's data func returns an error.
+// Default is false, the view is rendered with the error.
+func FailOnViewDataError(enable bool) Option {
+	return func(renderer *renderer) {
+		renderer.failOnViewDataError = enable
+	}
+}
 
-				for k, v := range defaultData {
-					viewData[k] = v
-				}
-			}
+// RequestID sets the template variable name containing the request id, and the request header it's read from.
+// A uuid is generated if the request doesn't have the header. The handler's log messages are prefixed with the request id.
+// Default is disabled, the header defaults to "X-Request-ID"
+func RequestID(header string, key string) Option {
+	return func(renderer *renderer) {
+		if header == "" {
+			header = "X-Request-ID"
+		}
+		renderer.requestIDHeader = header
+		renderer.requestIDKey = key
+	}
+}
 
-			// `errorkey` errors are merged. everything else is overwritten
-			for _, dataFunc := range dataFuncs {
-				data, err := dataFunc(w, r)
-				if err != nil {
-					// a wrapped error is shown to the user.
-					viewError := errors.Unwrap(err)
-					if viewError != nil {
-						errStrings = append(errStrings, first(strings.ToLower(viewError.Error())))
-						log.Printf("user error => renderlayout:defaultData => %v \n ", err)
-					} else {
-						log.Printf("internal error => renderlayout:defaultData => %v \n ", err)
-					}
-				}
+// LazyPartials parses only the partials referenced by a view, when the view is parsed. Default is false, every
+// partial is parsed with every view.
+// A partial is referenced with {{template "name"}}, by its path, e.g. "partials/main", or its file name, e.g. "main",
+// which is also how the partial's defined template is expected to be named.
+func LazyPartials(enable bool) Option {
+	return func(renderer *renderer) {
+		renderer.lazyPartials = enable
+	}
+}
 
-				for k, v := range data {
-					viewData[k] = v
-				}
-			}
-			if len(errStrings) > 0 {
-				viewData[lr.errorKey] = errStrings
-			}
+// NegotiateJSON responds with the view data as JSON instead of rendering the view, when the request accepts
+// application/json. Default is false
+func NegotiateJSON(enable bool) Option {
+	return func(renderer *renderer) {
+		renderer.negotiateJSON = enable
+	}
+}
 
-			err = lr.viewEngine.Render(w, http.StatusOK, view, viewData)
-			if err != nil {
-				log.Printf("renderlayout:render view [%s.%s],  error: %v, with data => \n %s \n",
-					view, lr.extension, err, pretty(viewData))
-				fmt.Fprintf(w, lr.renderError)
-				return
-			} else {
-				if lr.debug {
-					log.Printf("renderlayout:render view: [%s.%s], with data => \n %s \n",
-						view, lr.extension, pretty(viewData))
-				}
-			}
-		}
-	}, nil
+// JSONIndent indents the JSON view data. Default is false, the JSON is compact.
+func JSONIndent(enable bool) Option {
+	return func(renderer *renderer) {
+		renderer.jsonIndent = enable
+	}
 }
 
-func pretty(data map[string]interface{}) string {
-	var viewDataStr string
-	b, err := json.MarshalIndent(data, "", "  ")
-	if err != nil {
-		log.Printf("error marshalling:%v\n", err)
-		viewDataStr = fmt.Sprintf("%v", data)
-	} else {
-		viewDataStr = string(b)
+// JSONEscapeHTML escapes <, > and & in the JSON view data strings, e.g. "<" is "\u003c". Default is true
+// With false, user errors and any other strings are written verbatim, which is unsafe for JSON embedded in html.
+func JSONEscapeHTML(enable bool) Option {
+	return func(renderer *renderer) {
+		renderer.jsonEscapeHTML = enable
 	}
-	return viewDataStr
+}
 
+// JSONErrorKey is the key of the view errors in the JSON view data, instead of the ErrorKey. A dotted key nests them in
+// objects, e.g. with "error.details" the errors are {"error": {"details": [...]}}, merged into the objects of the view
+// data. The render fails if a key of the path isn't an object. Templates still get them with the ErrorKey. Default is
+// empty, the ErrorKey
+func JSONErrorKey(key string) Option {
+	return func(renderer *renderer) {
+		renderer.jsonErrorKey = key
+	}
 }
 
-type renderer struct {
+// ErrorsNewestFirst orders the errors under the `errorkey` from the last data func to run to the first, e.g. for a
+// stack of notifications. Default is false, the errors are in the order the data funcs ran
+func ErrorsNewestFirst(enable bool) Option {
+	return func(renderer *renderer) {
+		renderer.errorsNewestFirst = enable
+	}
+}
+
+// ValidationStatus responds with the status instead of 200 when data funcs return user errors, e.g. for a form failing
+// validation, re-rendered with its errors. A status of 0 is http.StatusUnprocessableEntity. A view rendered with
+// another status, e.g. by Respond, keeps it. The error of a data func recovered from a panic isn't a validation error,
+// so it's rendered with 200. Default is unset, user errors are rendered with 200
+func ValidationStatus(status int) Option {
+	return func(renderer *renderer) {
+		if status == 0 {
+			status = http.StatusUnprocessableEntity
+		}
+		renderer.validationStatus = status
+	}
+}
+
+// StructuredErrors shows a FieldError returned by a data func to the user as a ViewError, so the template can access
+// its code, field and message, e.g. {{(index .errors 0).Field}}. Other user errors are still strings. Default is false
+func StructuredErrors(enable bool) Option {
+	return func(renderer *renderer) {
+		renderer.structuredErrors = enable
+	}
+}
+
+// TrimWhitespace removes the whitespace spanning lines between html tags and template actions in the templates.
+// e.g. "<ul>\n    {{range .items}}" is "<ul>{{range .items}}". The content of <pre> elements and whitespace within a line
+// are kept. Default is false
+func TrimWhitespace(enable bool) Option {
+	return func(renderer *renderer) {
+		renderer.trimWhitespace = enable
+	}
+}
+
+// TrimOutput strips the leading and trailing whitespace of the rendered response body, e.g. the newlines left by the
+// template structure. Setting it renders views into a buffer before writing them out. Default is false
+func TrimOutput(enable bool) Option {
+	return func(renderer *renderer) {
+		renderer.trimOutput = enable
+	}
+}
+
+// StripComments removes the html comments from the rendered response body, e.g. conditional comments for legacy
+// browsers in production. html/template already removes the comments of the templates, so these are the comments of
+// trusted content, e.g. safeHTML, or of the views in text mode. Comments within <script> and <style> elements, and
+// those starting with "<!--!", e.g. <!--! license -->, are kept. Setting it renders views into a buffer before writing
+// them out. Default is false
+func StripComments(enable bool) Option {
+	return func(renderer *renderer) {
+		renderer.stripComments = enable
+	}
+}
+
+// Brotli compresses the rendered response body with brotli for the requests accepting the br content encoding, setting
+// "Content-Encoding: br" and "Vary: Accept-Encoding". Setting it renders views into a buffer before writing them out.
+// Default is false
+func Brotli(enable bool) Option {
+	return func(renderer *renderer) {
+		renderer.brotli = enable
+	}
+}
+
+// StrictKeys aborts the render with a 500 and the RenderError when a data func returns a key set by the renderer,
+// e.g. the ErrorKey, which would be overwritten. Default is false, it's logged as a warning in debug mode.
+func StrictKeys(enable bool) Option {
+	return func(renderer *renderer) {
+		renderer.strictKeys = enable
+	}
+}
+
+// TextMode renders the views with text/template instead of html/template, for output that isn't html, e.g. plain text
+// or config files. The output isn't escaped in text mode, so data from users can inject markup or scripts if the output
+// is served as html; only use it for views that aren't. The content type is text/plain unless the view is standalone.
+// Lazy partials and the cache of static included partials don't apply. Default is false
+func TextMode(enable bool) Option {
+	return func(renderer *renderer) {
+		renderer.textMode = enable
+	}
+}
+
+// Trace starts a span around each phase of a render, e.g. with an OpenTelemetry tracer, without depending on one.
+// start is called with the request's context, the span name, i.e. "renderlayout.data" for calling the data funcs
+// and "renderlayout.render" for executing the templates, and the attributes: view, layout and the status of the
+// render. It returns the context of the span, passed on with the request, and the func ending the span with the
+// error of the phase, if any. Default is nil
+func Trace(start func(ctx context.Context, name string, attrs map[string]string) (context.Context,
+	func(err error))) Option {
+	return func(renderer *renderer) {
+		renderer.startSpan = start
+	}
+}
+
+// LayeredFS reads the templates from the layers instead of the templates path, e.g. for theme overrides. A file is read
+// from the first layer which has it, so a layer overrides the files of the layers after it. Paths within a layer are
+// like within the templates path, e.g. "partials/header.html", and the partials are discovered in every layer.
+// A layout in LayoutsRoot is still read from disk. Default is nil
+func LayeredFS(layers ...fs.FS) Option {
+	return func(renderer *renderer) {
+		renderer.loader = layeredLoader(layers)
+	}
+}
+
+// SnapshotDir writes a snapshot of every render in debug mode to a file in dir, e.g. for golden tests of the views.
+// The file of a view, e.g. "account_settings.snap" for "account/settings", has the view name, the view data and the
+// rendered output, and is overwritten by the next render of the view. Default is empty
+func SnapshotDir(dir string) Option {
+	return func(renderer *renderer) {
+		renderer.snapshotDir = dir
+	}
+}
+
+// SkipBrokenPartials leaves out the partials failing to parse in debug mode, logging a warning, so the views which
+// don't use them still render during development. Outside of debug mode a broken partial fails the render. Default is false
+func SkipBrokenPartials(enable bool) Option {
+	return func(renderer *renderer) {
+		renderer.skipBrokenPartials = enable
+	}
+}
+
+// CaseInsensitivePaths resolves the files of views, layouts and partials ignoring case, e.g. the view "Home" is the file
+// "home.html", for case sensitive filesystems during development. The files in the templates path are listed when
+// the templates are loaded, and on Reload. It doesn't apply to a Loader. Default is false
+func CaseInsensitivePaths(enable bool) Option {
+	return func(renderer *renderer) {
+		renderer.caseInsensitivePaths = enable
+	}
+}
+
+// PartialAliases sets aliases of partials, by the partial's file name, e.g. "user_card.html", or template name, e.g.
+// "partials/user_card", so templates include them by the alias: {"card": "user_card"} renders the partial with
+// {{template "card" .}}. Default is nil
+func PartialAliases(aliases map[string]string) Option {
+	return func(renderer *renderer) {
+		renderer.partialAliases = aliases
+	}
+}
+
+// ValidatePartialRefs parses the views in the templates path in New, returning an error if a view fails to parse or
+// invokes a template which isn't defined, e.g. {{ template "partials/missing" }}, instead of failing on its first
+// render. Views are the files with the extension in the ViewsPath, outside of the layouts and partials paths. It
+// doesn't apply to a Loader. Default is false
+func ValidatePartialRefs(enable bool) Option {
+	return func(renderer *renderer) {
+		renderer.validatePartialRefs = enable
+	}
+}
+
+// LayoutPartials scopes partials to layouts, by the layout name, e.g. {"app": {"admin_toolbar"}}. A scoped partial is
+// only available when rendering with one of its layouts, other partials are available with any layout. A partial is
+// named by its file name or its template name, e.g. "partials/admin_toolbar". Default is nil
+func LayoutPartials(layoutPartials map[string][]string) Option {
+	return func(renderer *renderer) {
+		renderer.layoutPartials = layoutPartials
+	}
+}
+
+// RequirePartials fails New, and Reload, if no partials with the template extension are discovered in the partials
+// path, e.g. when the extension doesn't match the files. Default is false
+func RequirePartials(enable bool) Option {
+	return func(renderer *renderer) {
+		renderer.requirePartials = enable
+	}
+}
+
+// PartialsManifest registers the partials listed by the file at path, in order, instead of discovering the partials
+// in the partials path. The file is a JSON array, e.g. ["header", "footer"], or has a partial per line. A partial is
+// named by its file name or its template name, e.g. "partials/header". Default is empty
+func PartialsManifest(path string) Option {
+	return func(renderer *renderer) {
+		renderer.partialsManifest = path
+	}
+}
+
+// LayoutSelector chooses the layout of every request, e.g. "app" for signed in users and "public" for guests. The
+// configured Layout is used if it returns an empty layout. Default is nil
+func LayoutSelector(selector func(r *http.Request) string) Option {
+	return func(renderer *renderer) {
+		renderer.layoutSelector = selector
+	}
+}
+
+// ErrorTranslator returns the text shown to the user for a user error, e.g. translated to the request's language.
+// It's called with the error shown to the user, i.e. the error wrapped by the error of the data func. If it returns
+// an empty string the error is shown as without a translator. Default is nil
+func ErrorTranslator(translator func(r *http.Request, err error) string) Option {
+	return func(renderer *renderer) {
+		renderer.errorTranslator = translator
+	}
+}
+
+// Streaming flushes the response where the layout calls {{ flush }}, so the browser gets what's rendered before it, e.g.
+// the <head> and the nav, and starts fetching assets while the rest of the layout and the view render. The layout is
+// executed once, and is expected to call flush after the nav and before {{ template "content" . }}. Once flushed, a
+// render error can only be appended to the response. flush is a no-op without Streaming, or when the output is
+// buffered, e.g. with AfterRender. Default is false
+func Streaming(enable bool) Option {
+	return func(renderer *renderer) {
+		renderer.streaming = enable
+	}
+}
+
+// MaxConcurrentRenders limits the renders executing the templates at the same time to n, e.g. to bound the memory of
+// buffered renders under load. A render beyond the limit waits for another to finish, or with reject, responds with
+// 503 and the RenderError right away. Default is 0, no limit
+func MaxConcurrentRenders(n int, reject bool) Option {
+	return func(renderer *renderer) {
+		renderer.maxRenders = n
+		renderer.rejectRenders = reject
+	}
+}
+
+// RenderTimeout limits the time of a render, covering the data funcs and the template execution, to d. The request's
+// context is cancelled at the deadline, and a render past it responds with 503 and the RenderError. The response is
+// buffered until the render is done, so a partial render isn't written, and Streaming doesn't flush. Default is 0, no
+// timeout
+func RenderTimeout(d time.Duration) Option {
+	return func(renderer *renderer) {
+		renderer.renderTimeout = d
+	}
+}
+
+// RequireKeys declares the keys the view data of the view requires, e.g. RequireKeys("checkout", "cart", "total").
+// A render missing any of them logs a warning, or with StrictKeys fails with a 500 and the RenderError. Default is nil
+func RequireKeys(view string, keys ...string) Option {
+	return func(renderer *renderer) {
+		if renderer.requiredKeys == nil {
+			renderer.requiredKeys = make(map[string][]string)
+		}
+		renderer.requiredKeys[view] = append(renderer.requiredKeys[view], keys...)
+	}
+}
+
+// SaveFlashes saves the flash messages set by data funcs with the "_flash" key, a string or a []string, in the store, e.g.
+// D{"_flash": "Saved"}. They're saved when the data func returns, before a responder error it returns, e.g. NoContent,
+// writes the response, and the key is removed from the view data. A data func writing the response itself, e.g. with
+// http.Redirect, calls store.SetFlash before writing instead, since a session cookie can't be set after it. Without a
+// store, the flash messages are logged as a warning and dropped. Default is nil
+func SaveFlashes(store FlashStore) Option {
+	return func(renderer *renderer) {
+		renderer.flashStore = store
+	}
+}
+
+// Loader loads the templates with the loader instead of reading them from the templates path, e.g. from a database.
+// Views, layouts and partials are loaded by their file name within the templates path, e.g. "partials/header.html",
+// and the partials are discovered with loader.List. A layout in LayoutsRoot is still read from disk. Default is nil
+func Loader(loader TemplateLoader) Option {
+	return func(renderer *renderer) {
+		renderer.loader = loader
+	}
+}
+
+// LogRequestOnError logs the method, path, query and headers of the request when a render fails, along with the view
+// data. The Authorization, Cookie and other credential headers are redacted. Default is false
+func LogRequestOnError(enable bool) Option {
+	return func(renderer *renderer) {
+		renderer.logRequestOnError = enable
+	}
+}
+
+// ReloadInterval checks the modification times of the template files every interval, and reloads the templates like
+// Reload if any changed, e.g. for development where fsnotify isn't available. Only the templates path and LayoutsRoot
+// are checked, not a Loader. It polls until the Render is closed with Close. Default is 0, disabled
+func ReloadInterval(interval time.Duration) Option {
+	return func(renderer *renderer) {
+		renderer.reloadInterval = interval
+	}
+}
+
+// Globals are merged into the view data of every render before the data funcs, which can overwrite them, e.g. the app
+// name and version. Unlike StaticData, the values are shared by the renders, so they must not be modified. Default is nil
+func Globals(globals D) Option {
+	return func(renderer *renderer) {
+		renderer.globals = globals
+	}
+}
+
+// AllowedViews restricts the views rendered to those listed, e.g. for a route rendering the view named by a path
+// parameter like /pages/{name}. Other views respond with a 404 without being loaded. Views are matched by the name passed
+// to Render, with or without the template extension. Default is nil, all views are allowed
+func AllowedViews(views []string) Option {
+	return func(renderer *renderer) {
+		renderer.allowedViews = make(map[string]bool, len(views))
+		for _, view := range views {
+			renderer.allowedViews[view] = true
+		}
+	}
+}
+
+// statusKey and statusTextKey are the view data keys of the status code and reason phrase of an error page.
+const (
+	statusKey     = "_status"
+	statusTextKey = "_status_text"
+)
+
+// setStatus sets the status code and the reason phrase of the status in the view data. A reason phrase returned by a
+// data func is kept.
+func setStatus(data D, status int) {
+	data[statusKey] = status
+	if _, ok := data[statusTextKey]; !ok {
+		data[statusTextKey] = http.StatusText(status)
+	}
+}
+
+// queryKey is the view data key of the query parameters bound by BindQuery.
+const queryKey = "query"
+
+// BindQuery sets the query parameters of the request, as url.Values, under the `query` key of the view data before the
+// data funcs, which can overwrite it, e.g. {{ .query.Get "sort" }} for a filter page. Default is false
+func BindQuery(enable bool) Option {
+	return func(renderer *renderer) {
+		renderer.bindQuery = enable
+	}
+}
+
+// langKey is the view data key of the language of the request set by AutoLang.
+const langKey = "_lang"
+
+// AutoLang sets the language of the request returned by lang, e.g. from the Accept-Language header or the user's
+// settings, under the `_lang` key of every render, e.g. <html lang="{{ ._lang }}">. An empty language isn't set.
+// Default is nil
+func AutoLang(lang func(r *http.Request) string) Option {
+	return func(renderer *renderer) {
+		renderer.lang = lang
+	}
+}
+
+// buildKey is the view data key of the BuildInfo.
+const buildKey = "_build"
+
+// BuildInfo sets the build metadata of the app, e.g. the git commit and build time, for every render under the
+// `_build` key, e.g. {{ ._build.commit }}. The data is shared by the renders, so it must not be modified. Default is nil
+func BuildInfo(info D) Option {
+	return func(renderer *renderer) {
+		renderer.buildInfo = info
+	}
+}
+
+// Manifest loads the asset manifest of a frontend build tool, e.g. vite or esbuild, from the JSON file at path, for the
+// template func manifest, returning the hashed file of an asset, e.g. {{ manifest "app.js" }} is "assets/app.4889e940.js"
+// The manifest maps an asset to its file, or to an object with the "file" key like vite's. With the cache disabled,
+// it's loaded on every call. Default is empty
+func Manifest(path string) Option {
+	return func(renderer *renderer) {
+		renderer.manifestPath = path
+	}
+}
+
+// CriticalCSS loads the CSS file at path in New, for the template func criticalCSS, returning it as template.CSS to
+// inline in the head: <style>{{ criticalCSS }}</style>. With the cache disabled, it's loaded on every call. Default is
+// empty
+func CriticalCSS(path string) Option {
+	return func(renderer *renderer) {
+		renderer.criticalCSSPath = path
+	}
+}
+
+// URLBuilder sets the func building the URL of a named route with its params, for the template func url, e.g.
+// {{ url "user.show" .ID }} with a builder of the router's routes, so templates don't hardcode paths. The params are
+// formatted with fmt.Sprint. Default is nil
+func URLBuilder(builder func(name string, params ...string) string) Option {
+	return func(renderer *renderer) {
+		renderer.urlBuilder = builder
+	}
+}
+
+// CSRF sets the func returning the CSRF token of the request, e.g. csrf.Token of gorilla/csrf, and the name of the form
+// field posting it, for the template funcs csrfToken, returning the token, and csrfField, rendering the hidden input
+// <input type="hidden" name="field" value="token">. Default is nil
+func CSRF(field string, token func(r *http.Request) string) Option {
+	return func(renderer *renderer) {
+		renderer.csrfField = field
+		renderer.csrfToken = token
+	}
+}
+
+func New(opts ...Option) (Render, error) {
+
+	lr := &renderer{
+		root:         "templates",
+		partials:     "partials",
+		errorKey:     "errors",
+		layout:       "index",
+		layouts:      "layouts",
+		extension:    ".html",
+		renderError:  "Something went wrong.",
+		missingKey:   "default",
+		disableCache: false,
+		debug:        false,
+		delims: goview.Delims{
+			Left:  "{{",
+			Right: "}}",
+		},
+		jsonEscapeHTML: true,
+		callFuncs:      make(map[string]bool),
+	}
+
+	for _, opt := range opts {
+		opt(lr)
+	}
+	lr.normalizeViews()
+
+	// the funcs added by options replace the renderlayout funcs of the same name.
+	allFuncs := builtinFuncs()
+	for k, v := range lr.funcs {
+		allFuncs[k] = v
+	}
+
+	for k, v := range sprig.FuncMap() {
+		allFuncs[k] = v
+	}
+
+	for _, dynamicFuncs := range lr.dynamicFuncs {
+		for k, v := range dynamicFuncs() {
+			allFuncs[k] = v
+		}
+	}
+
+	lr.funcs = allFuncs
+	if lr.replaceFuncs {
+		lr.funcs = make(template.FuncMap, len(lr.replacedFuncs))
+		for k, v := range lr.replacedFuncs {
+			lr.funcs[k] = v
+		}
+		if _, ok := lr.funcs["flush"]; !ok {
+			lr.funcs["flush"] = builtinFuncs()["flush"]
+		}
+		lr.dynamicFuncs = nil
+	}
+
+	if lr.manifestPath != "" {
+		manifestFunc, err := lr.manifestFunc()
+		if err != nil {
+			return nil, err
+		}
+		lr.funcs["manifest"] = manifestFunc
+	}
+
+	if lr.criticalCSSPath != "" {
+		criticalCSSFunc, err := lr.criticalCSSFunc()
+		if err != nil {
+			return nil, err
+		}
+		lr.funcs["criticalCSS"] = criticalCSSFunc
+	}
+
+	if lr.urlBuilder != nil {
+		lr.funcs["url"] = urlFunc(lr.urlBuilder)
+	}
+
+	if lr.csrfToken != nil {
+		// the funcs are bound to the request by every render.
+		for name, fn := range lr.csrfFuncs(nil) {
+			lr.funcs[name] = fn
+		}
+	}
+
+	if lr.maxRenders > 0 {
+		lr.renderSlots = make(chan struct{}, lr.maxRenders)
+	}
+
+	switch lr.missingKey {
+	case "default", "invalid", "zero", "error":
+	default:
+		return nil, fmt.Errorf("renderlayout: invalid missingkey mode %q", lr.missingKey)
+	}
+
+	viewEngine, err := lr.newEngine()
+	if err != nil {
+		return nil, err
+	}
+
+	if lr.validatePartialRefs && lr.loader == nil {
+		if err := lr.validateRefs(); err != nil {
+			return nil, err
+		}
+	}
+
+	lr.setEngine(viewEngine)
+	if lr.reloadInterval > 0 {
+		lr.stopPolling = make(chan struct{})
+		go lr.pollTemplates(lr.templateModTimes())
+	}
+	return lr.render, nil
+}
+
+// validateRefs parses the views in the ViewsPath with their layout and partials, and returns an error if a view
+// invokes a template which isn't defined, e.g. a missing partial. Undefined funcs are placeholders, so the views
+// calling funcs added by WithFuncs parse.
+func (lr *renderer) validateRefs() error {
+	viewEngine, err := lr.newEngine()
+	if err != nil {
+		return err
+	}
+	viewEngine.placeholderFuncs = true
+	viewEngine.skipBrokenPartials = false
+
+	var views []string
+	err = filepath.Walk(filepath.Join(lr.root, filepath.FromSlash(lr.viewsPath)), func(file string, info os.FileInfo,
+		err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(lr.root, file)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if info.IsDir() {
+			if rel == lr.layouts || rel == lr.partials {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if filepath.Ext(rel) == lr.extension {
+			views = append(views, strings.TrimSuffix(rel, lr.extension))
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("renderlayout:validate views => %v", err)
+	}
+
+	for _, view := range views {
+		name, useMaster := viewEngine.view(view)
+		master := ""
+		if useMaster {
+			master = viewEngine.config.Master
+		}
+		tpl, err := viewEngine.parseTemplate(name, master, "")
+		if err != nil {
+			return fmt.Errorf("renderlayout:validate view [%s] => %v", view, err)
+		}
+		if refs := undefinedRefs(tpl); len(refs) > 0 {
+			sort.Strings(refs)
+			return fmt.Errorf("renderlayout:validate view [%s] => undefined templates %q", view, refs)
+		}
+	}
+	return nil
+}
+
+// pollTemplates reloads the engine when the modification times of the template files change from modTimes, every
+// ReloadInterval, until stopPolling is closed.
+func (lr *renderer) pollTemplates(modTimes map[string]time.Time) {
+	ticker := time.NewTicker(lr.reloadInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-lr.stopPolling:
+			return
+		case <-ticker.C:
+		}
+		current := lr.templateModTimes()
+		if reflect.DeepEqual(current, modTimes) {
+			continue
+		}
+		modTimes = current
+		viewEngine, err := lr.newEngine()
+		if err != nil {
+			log.Printf("renderlayout:reload templates, error: %v \n", err)
+			continue
+		}
+		lr.setEngine(viewEngine)
+	}
+}
+
+// templateModTimes returns the modification times of the files in the templates path and LayoutsRoot.
+func (lr *renderer) templateModTimes() map[string]time.Time {
+	modTimes := make(map[string]time.Time)
+	for _, root := range []string{lr.root, lr.layoutsRoot} {
+		if root == "" {
+			continue
+		}
+		filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if err == nil && !info.IsDir() {
+				modTimes[path] = info.ModTime()
+			}
+			return nil
+		})
+	}
+	return modTimes
+}
+
+// templatePaths returns the paths of the files in the templates path and LayoutsRoot by their lower cased path.
+func (lr *renderer) templatePaths() map[string]string {
+	paths := make(map[string]string)
+	for _, root := range []string{lr.root, lr.layoutsRoot} {
+		if root == "" {
+			continue
+		}
+		filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if err == nil && !info.IsDir() {
+				paths[strings.ToLower(path)] = path
+			}
+			return nil
+		})
+	}
+	return paths
+}
+
+// newEngine discovers the partials and returns the engine rendering the views.
+func (lr *renderer) newEngine() (*engine, error) {
+	partials, err := lr.discoverPartials()
+	if err != nil {
+		return nil, err
+	}
+	if lr.requirePartials && len(partials) == 0 {
+		return nil, fmt.Errorf("renderlayout: no partials with the extension %s in %s", lr.extension, lr.partials)
+	}
+
+	viewEngine := newEngine(goview.Config{
+		Root:         lr.root,
+		Extension:    lr.extension,
+		Master:       fmt.Sprintf("%s/%s", lr.layouts, lr.layout),
+		Partials:     partials,
+		DisableCache: lr.disableCache,
+		Funcs:        lr.funcs, // http://masterminds.github.io/sprig/
+		Delims:       lr.delims,
+	}, fmt.Sprintf("missingkey=%s", lr.missingKey))
+	var paths map[string]string
+	if lr.caseInsensitivePaths {
+		paths = lr.templatePaths()
+	}
+	viewEngine.fileHandler = lr.fileHandler(paths)
+	viewEngine.lazyPartials = lr.lazyPartials
+	viewEngine.placeholderFuncs = lr.debug
+	viewEngine.callFunc = lr.isCallFunc
+	viewEngine.partialAliases = lr.aliasedPartials()
+	viewEngine.skipBrokenPartials = lr.debug && lr.skipBrokenPartials
+	viewEngine.layoutPartials = lr.scopedPartials()
+
+	return viewEngine, nil
+}
+
+// discoverPartials returns the template names of the partials in the partials path, or those listed by the
+// PartialsManifest.
+func (lr *renderer) discoverPartials() ([]string, error) {
+	if lr.partialsManifest != "" {
+		names, err := loadPartialsManifest(lr.partialsManifest)
+		if err != nil {
+			return nil, err
+		}
+		partials := make([]string, len(names))
+		for i, name := range names {
+			partials[i] = lr.partialName(name)
+		}
+		return partials, nil
+	}
+
+	files, err := lr.partialFiles()
+	if err != nil {
+		return nil, err
+	}
+	var partials []string
+	for _, file := range files {
+		if !strings.HasSuffix(file, lr.extension) {
+			continue
+		}
+		partials = append(partials, fmt.Sprintf("%s/%s",
+			lr.partials,
+			strings.TrimSuffix(file, lr.extension)))
+	}
+	return partials, nil
+}
+
+// viewName returns the name of the view without the template extension, e.g. "home" for "home.html", the name the
+// views of the options are matched by.
+func (lr *renderer) viewName(view string) string {
+	return strings.TrimSuffix(view, lr.extension)
+}
+
+// normalizeViews names the views of the RequireKeys, LayoutDataFor and AllowedViews options without the template
+// extension, so they apply however the view is named when it's rendered.
+func (lr *renderer) normalizeViews() {
+	if lr.requiredKeys != nil {
+		requiredKeys := make(map[string][]string, len(lr.requiredKeys))
+		for view, keys := range lr.requiredKeys {
+			requiredKeys[lr.viewName(view)] = append(requiredKeys[lr.viewName(view)], keys...)
+		}
+		lr.requiredKeys = requiredKeys
+	}
+	if lr.layoutDataFor != nil {
+		layoutDataFor := make(map[string]Data, len(lr.layoutDataFor))
+		for view, dataFunc := range lr.layoutDataFor {
+			layoutDataFor[lr.viewName(view)] = dataFunc
+		}
+		lr.layoutDataFor = layoutDataFor
+	}
+	if lr.allowedViews != nil {
+		allowedViews := make(map[string]bool, len(lr.allowedViews))
+		for view := range lr.allowedViews {
+			allowedViews[lr.viewName(view)] = true
+		}
+		lr.allowedViews = allowedViews
+	}
+}
+
+// partialName returns the template name of a partial named by its file name, e.g. "header.html" or "header", or its
+// template name, e.g. "partials/header".
+func (lr *renderer) partialName(name string) string {
+	name = strings.TrimSuffix(name, lr.extension)
+	if !strings.HasPrefix(name, lr.partials+"/") {
+		name = fmt.Sprintf("%s/%s", lr.partials, name)
+	}
+	return name
+}
+
+// loadPartialsManifest returns the partials listed by the manifest file, a JSON array or a partial per line. Empty
+// lines and lines starting with # are skipped.
+func loadPartialsManifest(path string) ([]string, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if content := bytes.TrimSpace(b); len(content) > 0 && content[0] == '[' {
+		var partials []string
+		if err := json.Unmarshal(content, &partials); err != nil {
+			return nil, fmt.Errorf("renderlayout:partials manifest %s => %v", path, err)
+		}
+		return partials, nil
+	}
+
+	var partials []string
+	for _, line := range strings.Split(string(b), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		partials = append(partials, line)
+	}
+	return partials, nil
+}
+
+// scopedPartials returns the partials of LayoutPartials by the master layout, with their template names.
+func (lr *renderer) scopedPartials() map[string][]string {
+	if len(lr.layoutPartials) == 0 {
+		return nil
+	}
+	scoped := make(map[string][]string, len(lr.layoutPartials))
+	for layout, partials := range lr.layoutPartials {
+		master := fmt.Sprintf("%s/%s", lr.layouts, layout)
+		for _, partial := range partials {
+			scoped[master] = append(scoped[master], lr.partialName(partial))
+		}
+	}
+	return scoped
+}
+
+// aliasedPartials returns the template names of the partials by their PartialAliases.
+func (lr *renderer) aliasedPartials() map[string]string {
+	if len(lr.partialAliases) == 0 {
+		return nil
+	}
+	aliased := make(map[string]string, len(lr.partialAliases))
+	for alias, partial := range lr.partialAliases {
+		aliased[alias] = lr.partialName(partial)
+	}
+	return aliased
+}
+
+// partialFiles returns the names of the files in the partials path, of any layer with LayeredFS.
+func (lr *renderer) partialFiles() ([]string, error) {
+	if lr.loader != nil {
+		return lr.loader.List(lr.partials)
+	}
+	fileInfo, err := ioutil.ReadDir(fmt.Sprintf("%s/%s", lr.root, lr.partials))
+	if err != nil {
+		return nil, err
+	}
+	files := make([]string, len(fileInfo))
+	for i, file := range fileInfo {
+		files[i] = file.Name()
+	}
+	return files, nil
+}
+
+// setEngine replaces the engine rendering the views, and the text engine sharing its configuration.
+func (lr *renderer) setEngine(viewEngine *engine) {
+	textViewEngine := newTextEngine(viewEngine)
+	lr.engineMutex.Lock()
+	lr.viewEngine = viewEngine
+	lr.textViewEngine = textViewEngine
+	lr.engineMutex.Unlock()
+}
+
+// engine returns the engine rendering the views with html/template.
+func (lr *renderer) engine() *engine {
+	lr.engineMutex.RLock()
+	defer lr.engineMutex.RUnlock()
+	return lr.viewEngine
+}
+
+// textEngine returns the engine rendering the views with text/template.
+func (lr *renderer) textEngine() *textEngine {
+	lr.engineMutex.RLock()
+	defer lr.engineMutex.RUnlock()
+	return lr.textViewEngine
+}
+
+// views returns the engine rendering the views, the text engine in text mode.
+func (lr *renderer) views() views {
+	if lr.textMode {
+		return lr.textEngine()
+	}
+	return lr.engine()
+}
+
+// render returns the handler rendering the view with the view data returned by dataFuncs.
+func (lr *renderer) render(view string, dataFuncs ...Data) http.HandlerFunc {
+	if view == rendererView {
+		return lr.probe
+	}
+	return lr.respond(http.StatusOK, nil, view, dataFuncs...)
+}
+
+// respond returns the handler rendering the view with the status and headers.
+func (lr *renderer) respond(status int, headers map[string]string, view string, dataFuncs ...Data) http.HandlerFunc {
+	handle := lr.withTimeout(view, false, lr.handle(status, headers, view, false, dataFuncs...))
+	return func(w http.ResponseWriter, r *http.Request) {
+		_ = handle(w, r)
+	}
+}
+
+// handle returns the handler rendering the view with the status and headers. With raise, the view is rendered into a
+// buffer and the render error is returned instead of writing the RenderError.
+func (lr *renderer) handle(status int, headers map[string]string, view string, raise bool,
+	dataFuncs ...Data) func(w http.ResponseWriter, r *http.Request) error {
+	view = lr.viewName(view)
+	if layoutData, ok := lr.layoutDataFor[view]; ok {
+		dataFuncs = append([]Data{LayoutData(layoutData)}, dataFuncs...)
+	}
+	return func(w http.ResponseWriter, r *http.Request) error {
+		if lr.allowedViews != nil && !lr.allowedViews[view] {
+			log.Printf("renderlayout:render view [%s] => not found, it isn't an allowed view \n", view)
+			http.NotFound(w, r)
+			return nil
+		}
+		for k, v := range headers {
+			w.Header().Set(k, v)
+		}
+
+		logf := log.Printf
+		requestID := ""
+		if lr.requestIDKey != "" {
+			requestID = r.Header.Get(lr.requestIDHeader)
+			if requestID == "" {
+				requestID = uuid.New().String()
+			}
+			logf = func(format string, v ...interface{}) {
+				log.Printf("[%s] "+format, append([]interface{}{requestID}, v...)...)
+			}
+		}
+
+		if lr.htmxAware {
+			w.Header().Add("Vary", "HX-Request")
+		}
+
+		dataReq, endSpan := lr.span(r, "data", map[string]string{"view": view, "layout": lr.layoutFor(r)})
+		guard := &writeGuard{ResponseWriter: w}
+		viewData, written, invalid, err := lr.viewData(guard, dataReq, logf, dataFuncs)
+		endSpan(err)
+		if written {
+			return nil
+		}
+		if guard.written {
+			logf("renderlayout:render view [%s] => skipped, the response was written by a data func \n", view)
+			return nil
+		}
+		if err != nil {
+			return lr.fail(w, raise, http.StatusInternalServerError, err, viewData)
+		}
+		if err := lr.checkRequiredKeys(logf, view, viewData); err != nil {
+			return lr.fail(w, raise, http.StatusInternalServerError, err, viewData)
+		}
+
+		if lr.requestIDKey != "" {
+			viewData[lr.requestIDKey] = requestID
+		}
+		status := status
+		if invalid && lr.validationStatus != 0 && status == http.StatusOK {
+			status = lr.validationStatus
+		}
+		if lr.buildInfo != nil {
+			viewData[buildKey] = lr.buildInfo
+		}
+		if lr.lang != nil {
+			if lang := lr.lang(r); lang != "" {
+				viewData[langKey] = lang
+			}
+		}
+		if status >= http.StatusBadRequest {
+			setStatus(viewData, status)
+		}
+
+		for _, hook := range lr.beforeRender {
+			viewData = hook(r, viewData)
+		}
+		setCacheControl(w, viewData)
+		setSurrogateKeys(w, viewData)
+		cacheable := w.Header().Get("Cache-Control") != "" || w.Header().Get("Surrogate-Key") != ""
+		if contentType, ok := viewData[contentTypeKey].(string); ok {
+			delete(viewData, contentTypeKey)
+			w.Header().Set("Content-Type", contentType)
+		}
+		callFuncs, _ := viewData[funcsKey].(template.FuncMap)
+		delete(viewData, funcsKey)
+
+		if lr.negotiateJSON {
+			w.Header().Add("Vary", "Accept")
+			if acceptsJSON(r) {
+				if err := lr.writeJSON(w, status, viewData); err != nil {
+					logf("renderlayout:render view [%s] as json, error: %v", view, err)
+					return lr.fail(w, raise, http.StatusInternalServerError, err, viewData)
+				}
+				return nil
+			}
+		}
+
+		var warnings []string
+		renderFuncs := lr.renderFuncs()
+		if len(callFuncs) > 0 {
+			renderFuncs = lr.addCallFuncs(renderFuncs, callFuncs)
+		}
+		if lr.csrfToken != nil {
+			csrfFuncs := lr.csrfFuncs(r)
+			for k, v := range renderFuncs {
+				csrfFuncs[k] = v
+			}
+			renderFuncs = csrfFuncs
+		}
+		if lr.debug {
+			allFuncs := make(template.FuncMap)
+			for k, v := range lr.funcs {
+				allFuncs[k] = v
+			}
+			for k, v := range renderFuncs {
+				allFuncs[k] = v
+			}
+			renderFuncs = warningFuncs(allFuncs, &warnings)
+		}
+
+		if lr.renderSlots != nil {
+			release, ok := lr.acquireRender(r)
+			if !ok {
+				err := fmt.Errorf("renderlayout:render view [%s] => rejected, %d renders in progress", view,
+					cap(lr.renderSlots))
+				logf("%v \n", err)
+				return lr.fail(w, raise, http.StatusServiceUnavailable, err, viewData)
+			}
+			defer release()
+		}
+
+		renderReq, endSpan := lr.span(r, "render",
+			map[string]string{"view": view, "layout": lr.layoutFor(r), "status": strconv.Itoa(status)})
+		// a cacheable response is buffered too, so a failed render isn't cached.
+		sent := true
+		if lr.buffered() || raise || cacheable {
+			out := &writeGuard{ResponseWriter: w}
+			err = lr.renderBuffered(out, renderReq, status, view, viewData, renderFuncs)
+			sent = out.written
+		} else {
+			if lr.streaming {
+				renderFuncs = flushFuncs(w, renderFuncs)
+			}
+			lr.setContentType(w, view)
+			w.WriteHeader(status)
+			err = lr.execute(w, renderReq, view, viewData, renderFuncs)
+		}
+		endSpan(err)
+		if err != nil {
+			logf("renderlayout:render view [%s.%s],  error: %v, with data => \n %s \n",
+				view, lr.extension, err, pretty(viewData))
+			if lr.logRequestOnError {
+				logf("renderlayout:render view [%s.%s], request => \n %s \n", view, lr.extension, requestDetails(r))
+			}
+			if !sent {
+				return lr.fail(w, raise, http.StatusInternalServerError, err, viewData)
+			}
+			if raise {
+				return err
+			}
+			fmt.Fprint(w, lr.errorBody(err, viewData))
+			return nil
+		} else {
+			if lr.debug {
+				logf("renderlayout:render view: [%s.%s], with data => \n %s \n",
+					view, lr.extension, pretty(viewData))
+				if len(warnings) > 0 {
+					logf("renderlayout:render view: [%s.%s], warnings => \n %s \n",
+						view, lr.extension, strings.Join(warnings, "\n "))
+				}
+			}
+		}
+		return nil
+	}
+}
+
+// rendererView is the view name used by the Render methods to reach the renderer behind a Render.
+const rendererView = "\x00renderer"
+
+// viewData returns the view data returned by the default data and dataFuncs. written reports whether the
+// response was written instead, by a responder error, invalid whether a data func returned a user error, except a
+// recovered panic, for the ValidationStatus, and err is the error failing the render, if any, with the view data
+// merged until then. `errorkey` errors and layout data are merged. everything else is overwritten
+func (lr *renderer) viewData(w http.ResponseWriter, r *http.Request, logf func(format string, v ...interface{}),
+	dataFuncs []Data) (viewData D, written, invalid bool, err error) {
+	viewData = make(D)
+	mergeData(viewData, lr.globals)
+	if lr.bindQuery {
+		viewData[queryKey] = r.URL.Query()
+	}
+	var viewErrors []interface{}
+	if lr.defaultData != nil {
+		defaultData, err := lr.callData(logf, "defaultData", lr.defaultData, w, r)
+		lr.saveFlashes(w, r, logf, "defaultData", defaultData)
+		if err != nil {
+			if responded(w, err) {
+				return nil, true, false, nil
+			}
+			errs := lr.viewErrors(logf, r, "defaultData", err)
+			var panicked *panicError
+			if len(errs) > 0 && !errors.As(err, &panicked) {
+				invalid = true
+			}
+			viewErrors = append(viewErrors, errs...)
+			if lr.failOnDefaultDataError {
+				return viewData, false, false, err
+			}
+		}
+
+		if err == nil && defaultData == nil && lr.requireDefaultData {
+			err := errors.New("returned no data")
+			logf("internal error => renderlayout:defaultData => %v \n ", err)
+			return viewData, false, false, err
+		}
+
+		if err := lr.checkKeys(logf, "defaultData", defaultData); err != nil {
+			return viewData, false, false, err
+		}
+		mergeData(viewData, defaultData)
+		r = dataContext(r, defaultData)
+	}
+
+	for _, dataFunc := range dataFuncs {
+		data, err := lr.callData(logf, "data", dataFunc, w, r)
+		lr.saveFlashes(w, r, logf, "data", data)
+		if err != nil {
+			if responded(w, err) {
+				return nil, true, false, nil
+			}
+			errs := lr.viewErrors(logf, r, "data", err)
+			var panicked *panicError
+			if len(errs) > 0 && !errors.As(err, &panicked) {
+				invalid = true
+			}
+			viewErrors = append(viewErrors, errs...)
+			if lr.failOnViewDataError {
+				return viewData, false, false, err
+			}
+		}
+
+		if err := lr.checkKeys(logf, "data", data); err != nil {
+			return viewData, false, false, err
+		}
+		mergeData(viewData, data)
+		r = dataContext(r, data)
+	}
+	delete(viewData, contextKey)
+	delete(viewData, flashKey)
+	if lr.errorsNewestFirst {
+		for i, j := 0, len(viewErrors)-1; i < j; i, j = i+1, j-1 {
+			viewErrors[i], viewErrors[j] = viewErrors[j], viewErrors[i]
+		}
+	}
+	if len(viewErrors) > 0 {
+		viewData[lr.errorKey] = lr.errorsData(viewErrors)
+	}
+	return viewData, false, invalid, nil
+}
+
+// saveFlashes saves the flash messages of the "_flash" key in the view data of a data func in the FlashStore.
+func (lr *renderer) saveFlashes(w http.ResponseWriter, r *http.Request, logf func(format string, v ...interface{}),
+	source string, data D) {
+	flash, ok := data[flashKey]
+	if !ok {
+		return
+	}
+	var msgs []string
+	switch f := flash.(type) {
+	case string:
+		msgs = []string{f}
+	case []string:
+		msgs = f
+	default:
+		logf("warning => renderlayout:%s => the %q key is a %T, not a string or []string \n ", source, flashKey, flash)
+		return
+	}
+	if lr.flashStore == nil {
+		logf("warning => renderlayout:%s => the flash messages %q are dropped without a FlashStore \n ", source, msgs)
+		return
+	}
+	for _, msg := range msgs {
+		if err := lr.flashStore.SetFlash(w, r, msg); err != nil {
+			logf("internal error => renderlayout:%s => saving the flash message %q: %v \n ", source, msg, err)
+			return
+		}
+	}
+}
+
+// callData calls the data func, recovering from a panic. The panic is logged with the stack, and returned as an error
+// shown to the user with the RenderError, so the other data funcs still run and the view renders.
+func (lr *renderer) callData(logf func(format string, v ...interface{}), source string, dataFunc Data,
+	w http.ResponseWriter, r *http.Request) (data D, err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			if p == http.ErrAbortHandler {
+				panic(p)
+			}
+			logf("internal error => renderlayout:%s => panic: %v \n %s \n ", source, p, debug.Stack())
+			data, err = nil, &panicError{source: source, value: p, renderError: lr.renderError}
+		}
+	}()
+	return dataFunc(w, r)
+}
+
+// panicError is the error of a data func recovered from a panic. It wraps the RenderError, shown to the user, but it
+// isn't a validation error, so it doesn't respond with the ValidationStatus.
+type panicError struct {
+	source      string
+	value       interface{}
+	renderError string
+}
+
+func (e *panicError) Error() string {
+	return fmt.Sprintf("renderlayout:%s => panic: %v: %s", e.source, e.value, e.renderError)
+}
+
+// Unwrap returns the RenderError shown to the user.
+func (e *panicError) Unwrap() error {
+	return errors.New(e.renderError)
+}
+
+// span starts the span of the render phase with the Trace option. It returns the request with the span's context and
+// the func ending the span.
+func (lr *renderer) span(r *http.Request, phase string, attrs map[string]string) (*http.Request, func(err error)) {
+	if lr.startSpan == nil {
+		return r, func(error) {}
+	}
+	ctx, end := lr.startSpan(r.Context(), "renderlayout."+phase, attrs)
+	return r.WithContext(ctx), end
+}
+
+// writeGuard is the ResponseWriter of the data funcs. It records whether a data func wrote the response, so the view
+// isn't rendered after it.
+type writeGuard struct {
+	http.ResponseWriter
+	written bool
+}
+
+func (g *writeGuard) WriteHeader(statusCode int) {
+	g.written = true
+	g.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (g *writeGuard) Write(b []byte) (int, error) {
+	g.written = true
+	return g.ResponseWriter.Write(b)
+}
+
+// Unwrap returns the ResponseWriter for http.ResponseController.
+func (g *writeGuard) Unwrap() http.ResponseWriter {
+	return g.ResponseWriter
+}
+
+// withTimeout returns handle limited by the RenderTimeout, if it's set. handle writes to a timeoutWriter, copied to the
+// response when it's done. Past the deadline, the response is a 503 with the RenderError, or with raise, the timeout
+// error is returned.
+func (lr *renderer) withTimeout(view string, raise bool,
+	handle func(w http.ResponseWriter, r *http.Request) error) func(w http.ResponseWriter, r *http.Request) error {
+	if lr.renderTimeout <= 0 {
+		return handle
+	}
+	return func(w http.ResponseWriter, r *http.Request) error {
+		ctx, cancel := context.WithTimeout(r.Context(), lr.renderTimeout)
+		defer cancel()
+
+		tw := &timeoutWriter{header: make(http.Header)}
+		done := make(chan error, 1)
+		panicked := make(chan interface{}, 1)
+		go func() {
+			defer func() {
+				if p := recover(); p != nil {
+					panicked <- p
+				}
+			}()
+			done <- handle(tw, r.WithContext(ctx))
+		}()
+
+		select {
+		case p := <-panicked:
+			panic(p)
+		case err := <-done:
+			if raise && err != nil {
+				// the failed response isn't written, like the response of handle without the RenderTimeout.
+				return err
+			}
+			for k, v := range tw.header {
+				w.Header()[k] = v
+			}
+			if tw.status == 0 {
+				tw.status = http.StatusOK
+			}
+			w.WriteHeader(tw.status)
+			w.Write(tw.buf.Bytes())
+			return err
+		case <-ctx.Done():
+			tw.timeout()
+			err := fmt.Errorf("renderlayout:render view [%s] => timed out after %v", view, lr.renderTimeout)
+			log.Printf("%v \n", err)
+			if raise {
+				return err
+			}
+			lr.writeError(w, http.StatusServiceUnavailable)
+			return nil
+		}
+	}
+}
+
+// timeoutWriter is the ResponseWriter of a render with the RenderTimeout. It buffers the response until the render is
+// done, and discards the writes after the timeout.
+type timeoutWriter struct {
+	mu       sync.Mutex
+	header   http.Header
+	buf      bytes.Buffer
+	status   int
+	timedOut bool
+}
+
+func (tw *timeoutWriter) Header() http.Header {
+	return tw.header
+}
+
+func (tw *timeoutWriter) WriteHeader(statusCode int) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.timedOut || tw.status != 0 {
+		return
+	}
+	tw.status = statusCode
+}
+
+func (tw *timeoutWriter) Write(b []byte) (int, error) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.timedOut {
+		return 0, http.ErrHandlerTimeout
+	}
+	if tw.status == 0 {
+		tw.status = http.StatusOK
+	}
+	return tw.buf.Write(b)
+}
+
+// timeout discards the writes after the timeout.
+func (tw *timeoutWriter) timeout() {
+	tw.mu.Lock()
+	tw.timedOut = true
+	tw.mu.Unlock()
+}
+
+// rendererProbe receives the renderer behind a Render when it's rendering rendererView.
+type rendererProbe struct {
+	http.ResponseWriter
+	renderer *renderer
+}
+
+func (lr *renderer) probe(w http.ResponseWriter, _ *http.Request) {
+	if p, ok := w.(*rendererProbe); ok {
+		p.renderer = lr
+	}
+}
+
+func (rnd Render) renderer() *renderer {
+	probe := &rendererProbe{}
+	rnd(rendererView)(probe, nil)
+	if probe.renderer == nil {
+		panic("renderlayout: Render wasn't created by New")
+	}
+	return probe.renderer
+}
+
+// Warm parses and caches the views, so the first render of a view doesn't have to. It's a no-op if the cache is
+// disabled. Any views included at render time are parsed at their first render.
+func (rnd Render) Warm(views ...string) error {
+	lr := rnd.renderer()
+	for _, view := range views {
+		name, err := lr.viewPath(view)
+		if err == nil {
+			err = lr.views().Warm(name)
+		}
+		if err != nil {
+			return fmt.Errorf("renderlayout:warm view [%s] => %w", view, err)
+		}
+	}
+	return nil
+}
+
+// Dependencies returns the layout and partial files the view is rendered with, and the files it includes with a
+// constant name, e.g. {{ include "widgets/card" }}, by their template names, e.g. ["layouts/index", "partials/header",
+// "widgets/card"], for cache invalidation or debugging. The view is parsed if it isn't cached.
+// It's nil if the view fails to parse.
+func (rnd Render) Dependencies(view string) []string {
+	lr := rnd.renderer()
+	name, err := lr.viewPath(view)
+	var deps []string
+	if err == nil {
+		deps, err = lr.views().Dependencies(name)
+	}
+	if err != nil {
+		log.Printf("renderlayout:dependencies view [%s] => %v \n", view, err)
+		return nil
+	}
+	return deps
+}
+
+// Close stops polling the template files for ReloadInterval, e.g. when the Render is replaced or at the end of a test.
+// The Render still renders the templates loaded last. It's a no-op without ReloadInterval.
+func (rnd Render) Close() {
+	lr := rnd.renderer()
+	if lr.stopPolling == nil {
+		return
+	}
+	lr.closePolling.Do(func() {
+		close(lr.stopPolling)
+	})
+}
+
+// Reload discovers the partials again and replaces the engine rendering the views, dropping the parsed templates.
+// Renders in progress finish with the previous engine. It's used to pick up template changes without a restart.
+func (rnd Render) Reload() error {
+	lr := rnd.renderer()
+	viewEngine, err := lr.newEngine()
+	if err != nil {
+		return err
+	}
+
+	lr.setEngine(viewEngine)
+	return nil
+}
+
+// Block renders the template named block, defined by the view, e.g. {{ define "row" }}, or by the partials, without the
+// layout and returns the rendered bytes, e.g. for htmx out-of-band swaps.
+func (rnd Render) Block(view, block string, data D) ([]byte, error) {
+	lr := rnd.renderer()
+	name, err := lr.viewPath(view)
+	if err != nil {
+		return nil, err
+	}
+	buf := new(bytes.Buffer)
+	if err := lr.views().RenderBlock(buf, name, block, data, lr.renderFuncs()); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// RenderFragment renders the view without the layout and returns the rendered bytes, e.g. for server-sent events.
+// The view's "content" block is rendered if it defines one, otherwise the whole view.
+func (rnd Render) RenderFragment(view string, data D) ([]byte, error) {
+	lr := rnd.renderer()
+	name, err := lr.viewPath(view)
+	if err != nil {
+		return nil, err
+	}
+	buf := new(bytes.Buffer)
+	if err := lr.views().RenderFragment(buf, name, data, lr.renderFuncs()); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Respond returns the handler rendering the view like Render, but with the status and headers. e.g. a 404 page.
+// An error page with a 4xx or 5xx status has the status code under the `_status` key and its reason phrase, e.g.
+// "Not Found", under the `_status_text` key, unless a data func returns it.
+func (rnd Render) Respond(status int, headers map[string]string, view string, dataFuncs ...Data) http.HandlerFunc {
+	return rnd.renderer().respond(status, headers, view, dataFuncs...)
+}
+
+// Direct returns the handler rendering the view with the data, merged over the DefaultData, for handlers building the
+// view data themselves instead of with data funcs. e.g. rnd.Direct("report", rl.D{"rows": rows})(w, r)
+// The data isn't modified by the render.
+func (rnd Render) Direct(view string, data D) http.HandlerFunc {
+	return rnd.renderer().render(view, func(w http.ResponseWriter, r *http.Request) (D, error) {
+		return data, nil
+	})
+}
+
+// HandlerE returns the handler rendering the view like Render, but returning the render error, e.g. a missing view,
+// instead of writing the RenderError, for error handling middleware. The view is rendered into a buffer, so nothing is
+// written to the response when it fails. The errors failing a render before it, e.g. of FailOnViewDataError,
+// StrictKeys or MaxConcurrentRenders, are returned too.
+func (rnd Render) HandlerE(view string, dataFuncs ...Data) func(http.ResponseWriter, *http.Request) error {
+	lr := rnd.renderer()
+	return lr.withTimeout(view, true, lr.handle(http.StatusOK, nil, view, true, dataFuncs...))
+}
+
+// RenderInline renders the template source with the template funcs and the partials, without the layout, e.g. for
+// one-off snippets that don't need a template file.
+func (rnd Render) RenderInline(tmpl string, data D) (string, error) {
+	buf := new(bytes.Buffer)
+	lr := rnd.renderer()
+	if err := lr.views().RenderInline(buf, tmpl, data, lr.renderFuncs()); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// viewSourceKey is the request context key of the viewSource of WithView.
+type viewSourceKey struct{}
+
+// viewSource is the source overriding the view's file for a render.
+type viewSource struct {
+	view string
+	src  string
+}
+
+// WithView returns the Render rendering the view from the template source instead of its file, with the funcs, layout
+// and partials, e.g. for an A/B test of its content. Other views are rendered like rnd does. The source isn't cached,
+// it's parsed for every render.
+func (rnd Render) WithView(view string, tmpl string) Render {
+	return func(name string, dataFuncs ...Data) http.HandlerFunc {
+		handler := rnd(name, dataFuncs...)
+		if name != view {
+			return handler
+		}
+		return func(w http.ResponseWriter, r *http.Request) {
+			ctx := context.WithValue(r.Context(), viewSourceKey{}, viewSource{view: view, src: tmpl})
+			handler(w, r.WithContext(ctx))
+		}
+	}
+}
+
+// CacheStats are the statistics of the template cache, counting the views, layouts and included partials parsed
+// for a render.
+type CacheStats struct {
+	// Hits are the templates found in the cache.
+	Hits uint64
+	// Misses are the templates parsed and added to the cache.
+	Misses uint64
+	// Size is the number of cached templates.
+	Size int
+}
+
+// CacheStats returns the statistics of the template cache since New or the last Reload. They're zero if the cache is
+// disabled.
+func (rnd Render) CacheStats() CacheStats {
+	lr := rnd.renderer()
+	stats := lr.engine().cacheStats()
+	textStats := lr.textEngine().cacheStats()
+	stats.Hits += textStats.Hits
+	stats.Misses += textStats.Misses
+	stats.Size += textStats.Size
+	return stats
+}
+
+// RenderAll renders the views of pages with their view data concurrently, e.g. for generating a static site, and
+// returns the rendered bytes by view. The views are rendered with the layout, without the default data. Every view is
+// rendered, and the errors of the views which failed are returned together.
+func (rnd Render) RenderAll(pages map[string]D) (map[string][]byte, error) {
+	lr := rnd.renderer()
+	views := make([]string, 0, len(pages))
+	for view := range pages {
+		views = append(views, view)
+	}
+	sort.Strings(views)
+
+	outputs := make([][]byte, len(views))
+	errs := make([]error, len(views))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < runtime.NumCPU() && i < len(views); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobs {
+				outputs[job], errs[job] = lr.renderPage(views[job], pages[views[job]])
+			}
+		}()
+	}
+	for i := range views {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	rendered := make(map[string][]byte, len(views))
+	var renderErrs dataErrors
+	for i, view := range views {
+		if errs[i] != nil {
+			renderErrs = append(renderErrs, fmt.Errorf("renderlayout:render view [%s] => %w", view, errs[i]))
+			continue
+		}
+		rendered[view] = outputs[i]
+	}
+	if len(renderErrs) > 0 {
+		return rendered, renderErrs
+	}
+	return rendered, nil
+}
+
+// renderPage renders the view with the layout and returns the rendered bytes.
+func (lr *renderer) renderPage(view string, data D) ([]byte, error) {
+	return lr.renderView(lr.views(), view, data)
+}
+
+// renderView renders the view with the engine, like a page.
+func (lr *renderer) renderView(views views, view string, data D) ([]byte, error) {
+	name, err := lr.viewPath(view)
+	if err != nil {
+		return nil, err
+	}
+	buf := new(bytes.Buffer)
+	if err := views.RenderWriter(buf, name, data, lr.renderFuncs()); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// RenderEmail renders the html and text parts of an email with the same data, e.g. for a multipart message. The html
+// view is rendered with html/template and the text view with text/template, like TextMode, so only the html is
+// escaped. Both are rendered like pages, with the layout unless they're standalone, e.g. "emails/welcome.txt".
+// A part is empty if its view is.
+func (rnd Render) RenderEmail(htmlView, textView string, data D) (html string, text string, err error) {
+	lr := rnd.renderer()
+	if htmlView != "" {
+		b, err := lr.renderView(lr.engine(), htmlView, data)
+		if err != nil {
+			return "", "", fmt.Errorf("renderlayout:render email view [%s] => %w", htmlView, err)
+		}
+		html = string(b)
+	}
+	if textView != "" {
+		b, err := lr.renderView(lr.textEngine(), textView, data)
+		if err != nil {
+			return "", "", fmt.Errorf("renderlayout:render email view [%s] => %w", textView, err)
+		}
+		text = string(b)
+	}
+	return html, text, nil
+}
+
+// RenderSandboxed renders the template source like RenderInline, but with only the allowed template funcs and without
+// the partials, e.g. for templates authored by users. A call to any other func, e.g. sprig's env, fails to parse. The
+// builtin funcs of text/template, e.g. len and index, are always available.
+func (rnd Render) RenderSandboxed(tmpl string, data D, allowedFuncs []string) (string, error) {
+	lr := rnd.renderer()
+	funcs := make(template.FuncMap, len(allowedFuncs))
+	for _, name := range allowedFuncs {
+		fn, ok := lr.funcs[name]
+		if !ok {
+			return "", fmt.Errorf("renderlayout:render sandboxed => unknown func %q", name)
+		}
+		funcs[name] = fn
+	}
+	buf := new(bytes.Buffer)
+	if err := lr.engine().RenderSandboxed(buf, tmpl, data, funcs); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// Preview renders the view with the view data loaded from the JSON file at jsonPath, for iterating on templates without
+// writing data funcs. The file is loaded on every request. It's only enabled when the cache is disabled, otherwise it
+// responds with 404.
+func (rnd Render) Preview(view string, jsonPath string) http.HandlerFunc {
+	lr := rnd.renderer()
+	if !lr.disableCache {
+		return func(w http.ResponseWriter, r *http.Request) {
+			log.Printf("renderlayout:preview view [%s] => disabled, cache is enabled \n", view)
+			http.NotFound(w, r)
+		}
+	}
+	return lr.render(view, func(w http.ResponseWriter, r *http.Request) (D, error) {
+		b, err := ioutil.ReadFile(jsonPath)
+		if err != nil {
+			return nil, err
+		}
+		var data D
+		if err := json.Unmarshal(b, &data); err != nil {
+			return nil, fmt.Errorf("renderlayout:preview %s => %v", jsonPath, err)
+		}
+		return data, nil
+	})
+}
+
+// fileHandler reads the templates from the templates path, or the TemplateLoader, and the layout from LayoutsRoot
+// if it's set.
+// Standalone views(e.g. sitemap.xml) are read from the file with the view's name, others get the template extension.
+func (lr *renderer) fileHandler(paths map[string]string) goview.FileHandler {
+	defaultHandler := goview.DefaultFileHandler()
+	return func(config goview.Config, tplFile string) (string, error) {
+		loader := lr.loader
+		if lr.layoutsRoot != "" && strings.HasPrefix(tplFile, lr.layouts+"/") {
+			config.Root = lr.layoutsRoot
+			tplFile = strings.TrimPrefix(tplFile, lr.layouts+"/")
+			loader = nil
+		}
+		if standalone(tplFile) {
+			// standalone views are named with their extension.
+			config.Extension = ""
+		}
+		var content string
+		var err error
+		if loader != nil {
+			content, err = loadTemplate(loader, config, tplFile)
+		} else {
+			content, err = defaultHandler(config, resolvePath(paths, config, tplFile))
+		}
+		if err != nil {
+			return "", err
+		}
+		if lr.trimWhitespace {
+			content = trimWhitespace(content, config.Delims)
+		}
+		return content, nil
+	}
+}
+
+// resolvePath returns the template file named like tplFile, ignoring case, in the paths by their lower cased path. It's
+// tplFile if it isn't in the paths.
+func resolvePath(paths map[string]string, config goview.Config, tplFile string) string {
+	if paths == nil {
+		return tplFile
+	}
+	file, ok := paths[strings.ToLower(filepath.Join(config.Root, tplFile+config.Extension))]
+	if !ok {
+		return tplFile
+	}
+	rel, err := filepath.Rel(config.Root, file)
+	if err != nil || len(rel) < len(config.Extension) {
+		return tplFile
+	}
+	return filepath.ToSlash(rel[:len(rel)-len(config.Extension)])
+}
+
+// loadTemplate loads the template file with the loader.
+func loadTemplate(loader TemplateLoader, config goview.Config, tplFile string) (string, error) {
+	name := tplFile + config.Extension
+	data, err := loader.Load(name)
+	if err != nil {
+		return "", fmt.Errorf("ViewEngine render read name:%v, path:%v, error: %v", tplFile, name, err)
+	}
+	return string(data), nil
+}
+
+// buffered reports whether views are rendered into a buffer before being written to the response.
+func (lr *renderer) buffered() bool {
+	return len(lr.afterRender) > 0 || lr.trimOutput || lr.stripComments || lr.brotli || lr.snapshots()
+}
+
+// snapshots reports whether renders are written to the SnapshotDir.
+func (lr *renderer) snapshots() bool {
+	return lr.debug && lr.snapshotDir != ""
+}
+
+// writeSnapshot writes the snapshot of the render of view to the SnapshotDir.
+func (lr *renderer) writeSnapshot(view string, data D, body []byte) error {
+	name := strings.NewReplacer("/", "_", "\\", "_").Replace(strings.Trim(view, "/")) + ".snap"
+	snapshot := fmt.Sprintf("view: %s\ndata:\n%s\noutput:\n%s", view, pretty(data), body)
+	return ioutil.WriteFile(filepath.Join(lr.snapshotDir, name), []byte(snapshot), 0644)
+}
+
+// execute renders the view, without the layout if it's a fragment. funcs are bound to the templates for this render.
+func (lr *renderer) execute(out io.Writer, r *http.Request, view string, data D, funcs template.FuncMap) error {
+	name, err := lr.viewPath(view)
+	if err != nil {
+		return err
+	}
+	master := fmt.Sprintf("%s/%s", lr.layouts, lr.layoutFor(r))
+	if src, ok := r.Context().Value(viewSourceKey{}).(viewSource); ok && src.view == view {
+		return lr.views().RenderSource(out, name, master, src.src, data, lr.fragment(r), funcs)
+	}
+	if lr.fragment(r) {
+		return lr.views().RenderFragment(out, name, data, funcs)
+	}
+	return lr.views().RenderLayout(out, name, master, data, funcs)
+}
+
+// layoutFor returns the layout of the request, chosen by the LayoutSelector, or the configured layout.
+func (lr *renderer) layoutFor(r *http.Request) string {
+	if lr.layoutSelector != nil {
+		if layout := lr.layoutSelector(r); layout != "" {
+			return layout
+		}
+	}
+	return lr.layout
+}
+
+// viewPath returns the template name of the view, which is within the views path if it's set.
+func (lr *renderer) viewPath(view string) (string, error) {
+	if lr.viewsPath == "" {
+		return view, nil
+	}
+	name := path.Join(lr.viewsPath, view)
+	if !strings.HasPrefix(name, lr.viewsPath+"/") {
+		return "", fmt.Errorf("renderlayout: view [%s] is outside the views path %s", view, lr.viewsPath)
+	}
+	return name, nil
+}
+
+// fragment reports whether the view is rendered without the layout for the request.
+func (lr *renderer) fragment(r *http.Request) bool {
+	if lr.fragmentWhen != nil && lr.fragmentWhen(r) {
+		return true
+	}
+	return lr.htmxAware && r.Header.Get("HX-Request") != "" && r.Header.Get("HX-Boosted") == ""
+}
+
+func (lr *renderer) renderBuffered(w http.ResponseWriter, r *http.Request, status int, view string, data D,
+	funcs template.FuncMap) error {
+	buf := new(bytes.Buffer)
+	err := lr.execute(buf, r, view, data, funcs)
+	if err != nil {
+		return err
+	}
+
+	body := buf.Bytes()
+	if lr.stripComments {
+		body = stripComments(body)
+	}
+	if lr.trimOutput {
+		body = bytes.TrimSpace(body)
+	}
+	for _, hook := range lr.afterRender {
+		body = hook(r, body)
+	}
+	if lr.snapshots() {
+		if err := lr.writeSnapshot(view, data, body); err != nil {
+			log.Printf("renderlayout:render view [%s] snapshot, error: %v \n", view, err)
+		}
+	}
+
+	lr.setContentType(w, view)
+	if lr.brotli {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if acceptsBrotli(r) {
+			compressed := new(bytes.Buffer)
+			bw := brotli.NewWriterLevel(compressed, brotli.DefaultCompression)
+			if _, err := bw.Write(body); err != nil {
+				return err
+			}
+			if err := bw.Close(); err != nil {
+				return err
+			}
+			body = compressed.Bytes()
+			w.Header().Set("Content-Encoding", "br")
+		}
+	}
+	w.WriteHeader(status)
+	_, err = w.Write(body)
+	return err
+}
+
+// acceptsBrotli reports whether the request accepts the br content encoding.
+func acceptsBrotli(r *http.Request) bool {
+	for _, encoding := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		parts := strings.Split(encoding, ";")
+		if strings.TrimSpace(parts[0]) != "br" {
+			continue
+		}
+		for _, param := range parts[1:] {
+			if q := strings.TrimSpace(param); strings.HasPrefix(q, "q=") {
+				if weight, err := strconv.ParseFloat(q[2:], 64); err == nil && weight == 0 {
+					return false
+				}
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// contentTypes are the content types of standalone views by extension. Other extensions are looked up with
+// mime.TypeByExtension.
+var contentTypes = map[string]string{
+	".xml":  "application/xml; charset=utf-8",
+	".rss":  "application/rss+xml; charset=utf-8",
+	".atom": "application/atom+xml; charset=utf-8",
+	".txt":  "text/plain; charset=utf-8",
+}
+
+// standalone reports whether the view is standalone, i.e. named with the extension of a known content type, e.g.
+// "sitemap.xml". A dot in another view's name, e.g. "release-1.2", isn't an extension.
+func standalone(name string) bool {
+	ext := filepath.Ext(name)
+	if ext == "" {
+		return false
+	}
+	if _, ok := contentTypes[ext]; ok {
+		return true
+	}
+	return mime.TypeByExtension(ext) != ""
+}
+
+// setContentType sets the content type of the view unless the response already has one. It's html, or plain text in
+// text mode, unless the view is standalone.
+func (lr *renderer) setContentType(w http.ResponseWriter, view string) {
+	header := w.Header()
+	if len(header["Content-Type"]) != 0 {
+		return
+	}
+	header["Content-Type"] = goview.HTMLContentType
+	if lr.textMode {
+		header.Set("Content-Type", contentTypes[".txt"])
+	}
+	if standalone(view) {
+		ext := filepath.Ext(view)
+		if contentType, ok := contentTypes[ext]; ok {
+			header.Set("Content-Type", contentType)
+		} else if contentType := mime.TypeByExtension(ext); contentType != "" {
+			header.Set("Content-Type", contentType)
+		}
+	}
+}
+
+// flushFuncs returns funcs with the flush func flushing w, if it's an http.Flusher.
+func flushFuncs(w http.ResponseWriter, funcs template.FuncMap) template.FuncMap {
+	flushFuncs := make(template.FuncMap, len(funcs)+1)
+	for k, v := range funcs {
+		flushFuncs[k] = v
+	}
+	flushFuncs["flush"] = func() string {
+		if flusher, ok := w.(http.Flusher); ok {
+			flusher.Flush()
+		}
+		return ""
+	}
+	return flushFuncs
+}
+
+// acquireRender acquires a slot of MaxConcurrentRenders for the render, waiting for one unless renders are rejected.
+// It returns the func releasing the slot, and false if there's no slot, or the request was canceled while waiting.
+func (lr *renderer) acquireRender(r *http.Request) (func(), bool) {
+	release := func() { <-lr.renderSlots }
+	if lr.rejectRenders {
+		select {
+		case lr.renderSlots <- struct{}{}:
+			return release, true
+		default:
+			return nil, false
+		}
+	}
+	select {
+	case lr.renderSlots <- struct{}{}:
+		return release, true
+	case <-r.Context().Done():
+		return nil, false
+	}
+}
+
+// renderFuncs returns the funcs bound to the templates for a render, i.e. the current funcs of AddDynamicFuncs.
+func (lr *renderer) renderFuncs() template.FuncMap {
+	if len(lr.dynamicFuncs) == 0 {
+		return nil
+	}
+	funcs := make(template.FuncMap)
+	for _, dynamicFuncs := range lr.dynamicFuncs {
+		for k, v := range dynamicFuncs() {
+			funcs[k] = v
+		}
+	}
+	return funcs
+}
+
+// addCallFuncs returns the render funcs with the funcs added to the render by WithFuncs. Their names are recorded, so
+// the templates calling them parse.
+func (lr *renderer) addCallFuncs(renderFuncs, callFuncs template.FuncMap) template.FuncMap {
+	funcs := make(template.FuncMap, len(renderFuncs)+len(callFuncs))
+	for k, v := range renderFuncs {
+		funcs[k] = v
+	}
+	lr.callFuncsMutex.Lock()
+	for k, v := range callFuncs {
+		funcs[k] = v
+		lr.callFuncs[k] = true
+	}
+	lr.callFuncsMutex.Unlock()
+	return funcs
+}
+
+// isCallFunc reports whether the func was added to a render by WithFuncs.
+func (lr *renderer) isCallFunc(name string) bool {
+	lr.callFuncsMutex.RLock()
+	defer lr.callFuncsMutex.RUnlock()
+	return lr.callFuncs[name]
+}
+
+func (lr *renderer) addFuncs(prefix string, funcMap template.FuncMap) {
+	if lr.funcs == nil {
+		lr.funcs = make(template.FuncMap)
+	}
+	for k, v := range funcMap {
+		lr.funcs[prefix+k] = v
+	}
+}
+
+// acceptsJSON reports whether the request accepts application/json.
+func acceptsJSON(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "application/json")
+}
+
+// writeJSON writes the view data as JSON.
+func (lr *renderer) writeJSON(w http.ResponseWriter, status int, data D) error {
+	if errs, ok := data[lr.errorKey]; ok && lr.jsonErrorKey != "" && lr.jsonErrorKey != lr.errorKey {
+		jsonData := make(D, len(data))
+		for k, v := range data {
+			jsonData[k] = v
+		}
+		delete(jsonData, lr.errorKey)
+		keys := strings.Split(lr.jsonErrorKey, ".")
+		parent := jsonData
+		for i, key := range keys[:len(keys)-1] {
+			// the objects of the view data are copied, not modified.
+			child := make(D)
+			switch existing := parent[key].(type) {
+			case nil:
+			case D:
+				for k, v := range existing {
+					child[k] = v
+				}
+			case map[string]interface{}:
+				for k, v := range existing {
+					child[k] = v
+				}
+			default:
+				return fmt.Errorf("renderlayout:json error key [%s] => %s isn't an object", lr.jsonErrorKey,
+					strings.Join(keys[:i+1], "."))
+			}
+			parent[key] = child
+			parent = child
+		}
+		parent[keys[len(keys)-1]] = errs
+		data = jsonData
+	}
+
+	buf := new(bytes.Buffer)
+	enc := json.NewEncoder(buf)
+	enc.SetEscapeHTML(lr.jsonEscapeHTML)
+	if lr.jsonIndent {
+		enc.SetIndent("", "  ")
+	}
+	if err := enc.Encode(data); err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// writeError writes the RenderError with the status.
+func (lr *renderer) writeError(w http.ResponseWriter, status int) {
+	w.WriteHeader(status)
+	fmt.Fprint(w, lr.renderError)
+}
+
+// fail fails the render with the status, dropping the cache headers of the response. With raise, err is returned
+// instead of writing the status and the errorBody.
+func (lr *renderer) fail(w http.ResponseWriter, raise bool, status int, err error, data D) error {
+	w.Header().Del("Cache-Control")
+	w.Header().Del("Surrogate-Key")
+	if raise {
+		return err
+	}
+	lr.writeFailure(w, status, err, data)
+	return nil
+}
+
+// writeFailure writes the status and the errorBody of the failed render.
+func (lr *renderer) writeFailure(w http.ResponseWriter, status int, err error, data D) {
+	w.WriteHeader(status)
+	fmt.Fprint(w, lr.errorBody(err, data))
+}
+
+// errorBody returns the body of a failed render, the RenderError. Outside of production, it's followed by the error
+// and the view data, escaped unless in text mode.
+func (lr *renderer) errorBody(err error, data D) string {
+	if lr.production() {
+		return lr.renderError
+	}
+	details := fmt.Sprintf("%v\n\n%s", err, pretty(data))
+	if lr.textMode {
+		return fmt.Sprintf("%s\n\n%s", lr.renderError, details)
+	}
+	return fmt.Sprintf("%s\n<pre>%s</pre>", lr.renderError, template.HTMLEscapeString(details))
+}
+
+// production reports whether the Environment is production.
+func (lr *renderer) production() bool {
+	return lr.environment == "" || lr.environment == "production"
+}
+
+// urlFunc returns the url template func, building the URL of a named route with the builder.
+func urlFunc(builder func(name string, params ...string) string) func(string, ...interface{}) string {
+	return func(name string, params ...interface{}) string {
+		strParams := make([]string, len(params))
+		for i, param := range params {
+			strParams[i] = fmt.Sprint(param)
+		}
+		return builder(name, strParams...)
+	}
+}
+
+// csrfFuncs returns the csrfToken and csrfField template funcs of the request. Without a request, e.g. when parsing,
+// the token is empty.
+func (lr *renderer) csrfFuncs(r *http.Request) template.FuncMap {
+	token := func() string {
+		if r == nil {
+			return ""
+		}
+		return lr.csrfToken(r)
+	}
+	return template.FuncMap{
+		"csrfToken": token,
+		"csrfField": func() template.HTML {
+			return template.HTML(fmt.Sprintf(`<input type="hidden" name="%s" value="%s">`,
+				template.HTMLEscapeString(lr.csrfField), template.HTMLEscapeString(token())))
+		},
+	}
+}
+
+// criticalCSSFunc returns the criticalCSS template func.
+func (lr *renderer) criticalCSSFunc() (func() (template.CSS, error), error) {
+	css, err := ioutil.ReadFile(lr.criticalCSSPath)
+	if err != nil {
+		return nil, fmt.Errorf("renderlayout:critical css => %v", err)
+	}
+	return func() (template.CSS, error) {
+		if !lr.disableCache {
+			return template.CSS(css), nil
+		}
+		reloaded, err := ioutil.ReadFile(lr.criticalCSSPath)
+		if err != nil {
+			return "", fmt.Errorf("renderlayout:critical css => %v", err)
+		}
+		return template.CSS(reloaded), nil
+	}, nil
+}
+
+// manifestFunc returns the manifest template func.
+func (lr *renderer) manifestFunc() (func(string) (string, error), error) {
+	manifest, err := loadManifest(lr.manifestPath)
+	if err != nil {
+		return nil, err
+	}
+	return func(asset string) (string, error) {
+		files := manifest
+		if lr.disableCache {
+			reloaded, err := loadManifest(lr.manifestPath)
+			if err != nil {
+				return "", err
+			}
+			files = reloaded
+		}
+		file, ok := files[asset]
+		if !ok {
+			return "", fmt.Errorf("renderlayout:manifest => asset %q not found in %s", asset, lr.manifestPath)
+		}
+		return file, nil
+	}, nil
+}
+
+// loadManifest returns the files of the assets in the manifest file.
+func loadManifest(path string) (map[string]string, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var entries map[string]json.RawMessage
+	if err := json.Unmarshal(b, &entries); err != nil {
+		return nil, fmt.Errorf("renderlayout:manifest %s => %v", path, err)
+	}
+
+	files := make(map[string]string, len(entries))
+	for asset, entry := range entries {
+		var file string
+		if err := json.Unmarshal(entry, &file); err == nil {
+			files[asset] = file
+			continue
+		}
+		var chunk struct {
+			File string `json:"file"`
+		}
+		if err := json.Unmarshal(entry, &chunk); err != nil {
+			return nil, fmt.Errorf("renderlayout:manifest %s => asset %q: %v", path, asset, err)
+		}
+		files[asset] = chunk.File
+	}
+	return files, nil
+}
+
+// reservedKeys returns the template variable names set by the renderer, which data funcs shouldn't return.
+func (lr *renderer) reservedKeys() []string {
+	keys := []string{lr.errorKey}
+	if lr.requestIDKey != "" {
+		keys = append(keys, lr.requestIDKey)
+	}
+	if lr.buildInfo != nil {
+		keys = append(keys, buildKey)
+	}
+	if lr.lang != nil {
+		keys = append(keys, langKey)
+	}
+	return keys
+}
+
+// checkKeys warns about the reserved keys in the data returned by a data func in debug mode, or returns an error about
+// them with StrictKeys.
+func (lr *renderer) checkKeys(logf func(format string, v ...interface{}), source string, data D) error {
+	if !lr.debug && !lr.strictKeys {
+		return nil
+	}
+	for _, key := range lr.reservedKeys() {
+		if _, ok := data[key]; !ok {
+			continue
+		}
+		if lr.strictKeys {
+			err := fmt.Errorf("renderlayout:%s => returned the reserved key %q", source, key)
+			logf("internal error => %v \n ", err)
+			return err
+		}
+		logf("warning => renderlayout:%s => returned the reserved key %q, it may be overwritten \n ", source, key)
+	}
+	return nil
+}
+
+// checkRequiredKeys logs a warning for the keys of RequireKeys missing from the view data. With StrictKeys it fails
+// the render instead.
+func (lr *renderer) checkRequiredKeys(logf func(format string, v ...interface{}), view string, data D) error {
+	var missing []string
+	for _, key := range lr.requiredKeys[view] {
+		if _, ok := data[key]; !ok {
+			missing = append(missing, key)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	if lr.strictKeys {
+		err := fmt.Errorf("renderlayout:render view [%s] => missing the required keys %q", view, missing)
+		logf("internal error => %v \n ", err)
+		return err
+	}
+	logf("warning => renderlayout:render view [%s] => missing the required keys %q \n ", view, missing)
+	return nil
+}
+
+// viewErrors returns the errors shown to the user, of the error returned by a data func. It's more than one if
+// the data func was built by Combine.
+func (lr *renderer) viewErrors(logf func(format string, v ...interface{}), r *http.Request, source string,
+	err error) []interface{} {
+	var viewErrors []interface{}
+	for _, err := range splitErrors(err) {
+		if viewError := lr.viewError(logf, r, source, err); viewError != nil {
+			viewErrors = append(viewErrors, viewError)
+		}
+	}
+	return viewErrors
+}
+
+// viewError logs the error returned by a data func, and returns the error shown to the user, or nil if it's not shown.
+// A wrapped error is shown to the user as a string, and with StructuredErrors a FieldError is shown as a ViewError.
+func (lr *renderer) viewError(logf func(format string, v ...interface{}), r *http.Request, source string,
+	err error) interface{} {
+	var fieldError FieldError
+	if lr.structuredErrors && errors.As(err, &fieldError) {
+		logf("user error => renderlayout:%s => %v \n ", source, err)
+		return ViewError{
+			Code:    fieldError.Code(),
+			Field:   fieldError.Field(),
+			Message: lr.userError(r, fieldError),
+		}
+	}
+
+	// a wrapped error is shown to the user.
+	viewError := errors.Unwrap(err)
+	if viewError == nil {
+		logf("internal error => renderlayout:%s => %v \n ", source, err)
+		return nil
+	}
+	logf("user error => renderlayout:%s => %v \n ", source, err)
+	return lr.userError(r, viewError)
+}
+
+// errorsData returns the user errors set in the view data. They are strings, unless StructuredErrors is enabled.
+func (lr *renderer) errorsData(viewErrors []interface{}) interface{} {
+	if lr.structuredErrors {
+		return viewErrors
+	}
+	errStrings := make([]string, len(viewErrors))
+	for i, viewError := range viewErrors {
+		errStrings[i] = viewError.(string)
+	}
+	return errStrings
+}
+
+// userError returns the error text shown to the user, translated by the ErrorTranslator if it's set.
+func (lr *renderer) userError(r *http.Request, err error) string {
+	if lr.errorTranslator != nil {
+		if msg := lr.errorTranslator(r, err); msg != "" {
+			return msg
+		}
+	}
+	if lr.rawErrors {
+		return err.Error()
+	}
+	return first(strings.ToLower(err.Error()))
+}
+
+// redactedHeaders are the headers logged as redacted by LogRequestOnError.
+var redactedHeaders = map[string]bool{
+	"Authorization":       true,
+	"Proxy-Authorization": true,
+	"Cookie":              true,
+	"X-Api-Key":           true,
+	"X-Auth-Token":        true,
+	"X-Csrf-Token":        true,
+}
+
+// requestDetails returns the method, path, query and headers of the request for the log, with the sensitive headers
+// redacted.
+func requestDetails(r *http.Request) string {
+	headers := make(map[string]string, len(r.Header))
+	for k, v := range r.Header {
+		if redactedHeaders[http.CanonicalHeaderKey(k)] {
+			headers[k] = "[redacted]"
+			continue
+		}
+		headers[k] = strings.Join(v, ", ")
+	}
+	return pretty(map[string]interface{}{
+		"method":  r.Method,
+		"path":    r.URL.Path,
+		"query":   r.URL.RawQuery,
+		"headers": headers,
+	})
+}
+
+func pretty(data map[string]interface{}) string {
+	var viewDataStr string
+	b, err := json.MarshalIndent(data, "", "  ")
+	if err != nil {
+		log.Printf("error marshalling:%v\n", err)
+		viewDataStr = fmt.Sprintf("%v", data)
+	} else {
+		viewDataStr = string(b)
+	}
+	return viewDataStr
+
+}
+
+type renderer struct {
 	errorKey     string
 	root         string
 	layout       string
 	layouts      string
+	layoutsRoot  string
+	viewsPath    string
 	partials     string
 	extension    string
 	disableCache bool
+	htmxAware    bool
 	renderError  string
+	rawErrors    bool
+	missingKey   string
 	delims       goview.Delims
 	funcs        template.FuncMap
+	dynamicFuncs []func() template.FuncMap
+
+	replacedFuncs template.FuncMap
+	replaceFuncs  bool
+
+	goviewConfig   *goview.Config
+	viewEngine     *engine
+	textViewEngine *textEngine
+	engineMutex    sync.RWMutex
+	defaultData    Data
+	globals        D
+	buildInfo      D
+	bindQuery      bool
+	lang           func(r *http.Request) string
+	beforeRender   []func(r *http.Request, data D) D
+	afterRender    []func(r *http.Request, body []byte) []byte
+	debug          bool
+
+	failOnDefaultDataError bool
+	failOnViewDataError    bool
+	requireDefaultData     bool
+	structuredErrors       bool
+	errorsNewestFirst      bool
+	strictKeys             bool
+	requirePartials        bool
+	logRequestOnError      bool
+	skipBrokenPartials     bool
+	caseInsensitivePaths   bool
+	validatePartialRefs    bool
+
+	requestIDHeader string
+	requestIDKey    string
+	lazyPartials    bool
+	trimWhitespace  bool
+	trimOutput      bool
+	stripComments   bool
+	brotli          bool
+	manifestPath    string
+	criticalCSSPath string
+	urlBuilder      func(name string, params ...string) string
+	csrfField       string
+	csrfToken       func(r *http.Request) string
+	snapshotDir     string
+	textMode        bool
+	loader          TemplateLoader
+	flashStore      FlashStore
+	layoutPartials  map[string][]string
+	startSpan       func(ctx context.Context, name string, attrs map[string]string) (context.Context, func(err error))
+
+	partialsManifest string
+	reloadInterval   time.Duration
+	stopPolling      chan struct{}
+	closePolling     sync.Once
+	layoutSelector   func(r *http.Request) string
+	fragmentWhen     func(r *http.Request) bool
+	errorTranslator  func(r *http.Request, err error) string
+	requiredKeys     map[string][]string
+	partialAliases   map[string]string
+	layoutDataFor    map[string]Data
+	allowedViews     map[string]bool
+	streaming        bool
+
+	callFuncs      map[string]bool
+	callFuncsMutex sync.RWMutex
+
+	maxRenders    int
+	rejectRenders bool
+	renderSlots   chan struct{}
+
+	negotiateJSON  bool
+	jsonIndent     bool
+	jsonEscapeHTML bool
+	jsonErrorKey   string
 
-	goviewConfig *goview.Config
-	viewEngine   *goview.ViewEngine
-	defaultData  Data
-	debug        bool
+	validationStatus int
+	renderTimeout    time.Duration
+	environment      string
 }
 
 func first(str string) string {
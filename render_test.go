@@ -0,0 +1,2075 @@
+package renderlayout
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/andybalholm/brotli"
+	"github.com/google/uuid"
+)
+
+// templates returns the files of a templates path with an index layout and a partial, overridden by files.
+func templates(files map[string]string) map[string]string {
+	all := map[string]string{
+		"layouts/index.html": `<html>{{ template "content" . }}</html>`,
+		"partials/main.html": `{{ define "main" }}main{{ end }}`,
+		"home.html":          `{{ define "content" }}hello {{ .hello }}{{ end }}`,
+	}
+	for name, content := range files {
+		all[name] = content
+	}
+	return all
+}
+
+// writeFiles writes the files to dir.
+func writeFiles(t testing.TB, dir string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		file := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// writeTemplates writes the templates(files) to a temporary templates path and returns it.
+func writeTemplates(t testing.TB, files map[string]string) string {
+	t.Helper()
+	root := t.TempDir()
+	writeFiles(t, root, templates(files))
+	return root
+}
+
+// newRender returns the Render of the templates(files) with the options.
+func newRender(t testing.TB, files map[string]string, opts ...Option) Render {
+	t.Helper()
+	rnd, err := New(append([]Option{TemplatesPath(writeTemplates(t, files))}, opts...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rnd
+}
+
+// get returns the response of the handler to a GET request, modified by the optional funcs.
+func get(handler http.HandlerFunc, modify ...func(r *http.Request)) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	for _, fn := range modify {
+		fn(r)
+	}
+	w := httptest.NewRecorder()
+	handler(w, r)
+	return w
+}
+
+// data returns the Data func returning d.
+func data(d D) Data {
+	return func(w http.ResponseWriter, r *http.Request) (D, error) {
+		return d, nil
+	}
+}
+
+// captureLog returns the buffer the log is written to until the end of the test.
+func captureLog(t *testing.T) *bytes.Buffer {
+	t.Helper()
+	buf := new(bytes.Buffer)
+	log.SetOutput(buf)
+	t.Cleanup(func() {
+		log.SetOutput(os.Stderr)
+	})
+	return buf
+}
+
+func TestExtension(t *testing.T) {
+	for _, extension := range []string{"html", ".html", ""} {
+		lr := &renderer{extension: ".html"}
+		Extension(extension)(lr)
+		if lr.extension != ".html" {
+			t.Errorf("Extension(%q) is %q, want .html", extension, lr.extension)
+		}
+	}
+
+	rnd := newRender(t, nil, Extension(".html"))
+	if body := get(rnd("home", data(D{"hello": "world"}))).Body.String(); body != "<html>hello world</html>" {
+		t.Errorf("body is %q", body)
+	}
+}
+
+func TestBeforeRender(t *testing.T) {
+	rnd := newRender(t, nil,
+		BeforeRender(func(r *http.Request, data D) D {
+			data["hello"] = "before"
+			return data
+		}),
+		BeforeRender(func(r *http.Request, data D) D {
+			data["hello"] = data["hello"].(string) + " render"
+			return data
+		}))
+	if body := get(rnd("home", data(D{"hello": "world"}))).Body.String(); body != "<html>hello before render</html>" {
+		t.Errorf("body is %q", body)
+	}
+}
+
+func TestAfterRender(t *testing.T) {
+	rnd := newRender(t, nil, AfterRender(func(r *http.Request, body []byte) []byte {
+		return append(body, "<!-- marker -->"...)
+	}))
+	if body := get(rnd("home", data(D{"hello": "world"}))).Body.String(); body != "<html>hello world</html><!-- marker -->" {
+		t.Errorf("body is %q", body)
+	}
+}
+
+// userError returns the Data func returning the wrapped user error msg.
+func userError(msg string) Data {
+	return func(w http.ResponseWriter, r *http.Request) (D, error) {
+		return nil, fmt.Errorf("loading, %w", errors.New(msg))
+	}
+}
+
+func TestRawErrors(t *testing.T) {
+	files := map[string]string{"errors.html": `{{ define "content" }}{{ range .errors }}{{ . }};{{ end }}{{ end }}`}
+	for _, tc := range []struct {
+		raw  bool
+		want string
+	}{
+		{false, "<html>Ios failed;</html>"},
+		{true, "<html>iOS failed;</html>"},
+	} {
+		rnd := newRender(t, files, RawErrors(tc.raw))
+		if body := get(rnd("errors", userError("iOS failed"))).Body.String(); body != tc.want {
+			t.Errorf("RawErrors(%v) body is %q, want %q", tc.raw, body, tc.want)
+		}
+	}
+}
+
+func TestAddFuncsReplaceBuiltinFuncs(t *testing.T) {
+	rnd := newRender(t, map[string]string{"items.html": `{{ define "content" }}{{ items }}{{ end }}`},
+		AddFuncs(template.FuncMap{"items": func() string { return "user items" }}))
+	if body := get(rnd("items")).Body.String(); body != "<html>user items</html>" {
+		t.Errorf("body is %q", body)
+	}
+}
+
+func TestLayoutsRoot(t *testing.T) {
+	layoutsRoot := t.TempDir()
+	writeFiles(t, layoutsRoot, map[string]string{"index.html": `<main>{{ template "content" . }}</main>`})
+	rnd := newRender(t, nil, LayoutsRoot(layoutsRoot))
+	if body := get(rnd("home", data(D{"hello": "world"}))).Body.String(); body != "<main>hello world</main>" {
+		t.Errorf("body is %q", body)
+	}
+}
+
+// countingLoader is a TemplateLoader of the templates(files) counting the loads of every file, i.e. its compiles.
+type countingLoader struct {
+	mu    sync.Mutex
+	files map[string]string
+	loads map[string]int
+}
+
+func newCountingLoader(files map[string]string) *countingLoader {
+	return &countingLoader{files: templates(files), loads: make(map[string]int)}
+}
+
+func (l *countingLoader) Load(name string) ([]byte, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	content, ok := l.files[name]
+	if !ok {
+		return nil, fmt.Errorf("open %s: %w", name, fs.ErrNotExist)
+	}
+	l.loads[name]++
+	return []byte(content), nil
+}
+
+func (l *countingLoader) List(dir string) ([]string, error) {
+	var names []string
+	for name := range l.files {
+		if path.Dir(name) == dir {
+			names = append(names, path.Base(name))
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// count returns the loads of the file.
+func (l *countingLoader) count(name string) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.loads[name]
+}
+
+func TestWarm(t *testing.T) {
+	loader := newCountingLoader(nil)
+	rnd, err := New(Loader(loader))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rnd.Warm("home"); err != nil {
+		t.Fatal(err)
+	}
+	if n := loader.count("home.html"); n != 1 {
+		t.Fatalf("home.html is compiled %d times by Warm, want 1", n)
+	}
+
+	if body := get(rnd("home", data(D{"hello": "world"}))).Body.String(); body != "<html>hello world</html>" {
+		t.Errorf("body is %q", body)
+	}
+	if n := loader.count("home.html"); n != 1 {
+		t.Errorf("home.html is compiled %d times after a render, want 1", n)
+	}
+	if err := rnd.Warm("missing"); err == nil {
+		t.Error("Warm of a missing view didn't fail")
+	}
+}
+
+func TestHTMXAware(t *testing.T) {
+	rnd := newRender(t, nil, HTMXAware(true))
+	handler := rnd("home", data(D{"hello": "world"}))
+	w := get(handler, func(r *http.Request) { r.Header.Set("HX-Request", "true") })
+	if body := w.Body.String(); body != "hello world" {
+		t.Errorf("htmx request body is %q, want the view without the layout", body)
+	}
+	if vary := w.Header().Get("Vary"); vary != "HX-Request" {
+		t.Errorf("Vary is %q", vary)
+	}
+	if body := get(handler).Body.String(); body != "<html>hello world</html>" {
+		t.Errorf("body is %q, want the layout", body)
+	}
+	boosted := get(handler, func(r *http.Request) {
+		r.Header.Set("HX-Request", "true")
+		r.Header.Set("HX-Boosted", "true")
+	})
+	if body := boosted.Body.String(); body != "<html>hello world</html>" {
+		t.Errorf("boosted request body is %q, want the layout", body)
+	}
+}
+
+type secret struct {
+	value string
+}
+
+type page struct {
+	Title   string
+	secret  secret
+	updated time.Time
+}
+
+func TestStaticData(t *testing.T) {
+	updated := time.Now()
+	original := D{
+		"page": page{Title: "home", secret: secret{"x"}, updated: updated},
+		"nav":  []string{"home", "about"},
+		"meta": D{"lang": "en"},
+	}
+	for _, tc := range []struct {
+		name      string
+		dataFunc  Data
+		immutable bool
+	}{
+		{"StaticData", StaticData(original), false},
+		{"StaticDataImmutable", StaticDataImmutable(original), true},
+	} {
+		var wg sync.WaitGroup
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				d, err := tc.dataFunc(nil, nil)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				d["page"] = page{Title: fmt.Sprint(i)}
+				delete(d, "meta")
+				d["request"] = i
+				if tc.immutable {
+					d["nav"].([]string)[0] = fmt.Sprint(i)
+				}
+			}(i)
+		}
+		wg.Wait()
+
+		d, _ := tc.dataFunc(nil, nil)
+		if len(d) != 3 || d["meta"].(D)["lang"] != "en" || d["nav"].([]string)[0] != "home" {
+			t.Errorf("%s: the data is modified, %v", tc.name, d)
+		}
+		if p := d["page"].(page); p.secret.value != "x" || !p.updated.Equal(updated) {
+			t.Errorf("%s: the unexported fields of the page are lost, %+v", tc.name, p)
+		}
+	}
+
+	d, _ := StaticDataImmutable(original)(nil, nil)
+	d["meta"].(D)["lang"] = "fr"
+	if original["meta"].(D)["lang"] != "en" {
+		t.Error("StaticDataImmutable: the nested map is shared")
+	}
+}
+
+func TestStandaloneView(t *testing.T) {
+	rnd := newRender(t, map[string]string{
+		"sitemap.xml": `<urlset>{{ range .pages }}<url><loc>{{ . }}</loc></url>{{ end }}</urlset>`,
+		"feed.rss":    `<rss>{{ .title }}</rss>`,
+	})
+	w := get(rnd("sitemap.xml", data(D{"pages": []string{"/", "/about"}})))
+	if body := w.Body.String(); body != "<urlset><url><loc>/</loc></url><url><loc>/about</loc></url></urlset>" {
+		t.Errorf("sitemap body is %q", body)
+	}
+	if contentType := w.Header().Get("Content-Type"); contentType != "application/xml; charset=utf-8" {
+		t.Errorf("sitemap content type is %q", contentType)
+	}
+	if contentType := get(rnd("feed.rss")).Header().Get("Content-Type"); contentType != "application/rss+xml; charset=utf-8" {
+		t.Errorf("feed content type is %q", contentType)
+	}
+}
+
+func TestDottedView(t *testing.T) {
+	rnd := newRender(t, map[string]string{
+		"release-1.2.html":         `{{ define "content" }}release {{ template "notes-v1.0" }}{{ end }}`,
+		"docs/v2.0.html":           `{{ define "content" }}docs{{ end }}`,
+		"partials/notes-v1.0.html": `{{ define "notes-v1.0" }}notes{{ end }}`,
+	})
+	for _, tc := range []struct {
+		view string
+		want string
+	}{
+		{"release-1.2", "<html>release notes</html>"},
+		{"release-1.2.html", "<html>release notes</html>"},
+		{"docs/v2.0", "<html>docs</html>"},
+	} {
+		w := get(rnd(tc.view))
+		if w.Body.String() != tc.want || w.Header().Get("Content-Type") != "text/html; charset=utf-8" {
+			t.Errorf("%s: response is %q with the content type %q, want %q", tc.view, w.Body.String(),
+				w.Header().Get("Content-Type"), tc.want)
+		}
+	}
+}
+
+func TestAddNamespacedFuncs(t *testing.T) {
+	rnd := newRender(t, map[string]string{"funcs.html": `{{ define "content" }}{{ billing_format 1 }} {{ shipping_format 1 }}{{ end }}`},
+		AddNamespacedFuncs("billing", template.FuncMap{"format": func(n int) string { return fmt.Sprintf("$%d", n) }}),
+		AddNamespacedFuncs("shipping_", template.FuncMap{"format": func(n int) string { return fmt.Sprintf("%dkg", n) }}))
+	if body := get(rnd("funcs")).Body.String(); body != "<html>$1 1kg</html>" {
+		t.Errorf("body is %q", body)
+	}
+}
+
+func TestFailOnDataErrors(t *testing.T) {
+	files := map[string]string{"errors.html": `{{ define "content" }}{{ range .errors }}{{ . }};{{ end }}{{ end }}`}
+	ok := data(D{})
+	for _, tc := range []struct {
+		failOnDefault, failOnView bool
+		defaultData, viewData     Data
+		status                    int
+		body                      string
+	}{
+		{false, false, userError("nav failed"), ok, http.StatusOK, "<html>Nav failed;</html>"},
+		{false, false, ok, userError("view failed"), http.StatusOK, "<html>View failed;</html>"},
+		{true, false, userError("nav failed"), ok, http.StatusInternalServerError, "Something went wrong."},
+		{true, false, ok, userError("view failed"), http.StatusOK, "<html>View failed;</html>"},
+		{false, true, userError("nav failed"), ok, http.StatusOK, "<html>Nav failed;</html>"},
+		{false, true, ok, userError("view failed"), http.StatusInternalServerError, "Something went wrong."},
+		{true, true, userError("nav failed"), ok, http.StatusInternalServerError, "Something went wrong."},
+		{true, true, ok, userError("view failed"), http.StatusInternalServerError, "Something went wrong."},
+	} {
+		rnd := newRender(t, files,
+			DefaultData(tc.defaultData), FailOnDefaultDataError(tc.failOnDefault), FailOnViewDataError(tc.failOnView))
+		w := get(rnd("errors", tc.viewData))
+		if w.Code != tc.status || w.Body.String() != tc.body {
+			t.Errorf("FailOnDefaultDataError(%v), FailOnViewDataError(%v): %d %q, want %d %q",
+				tc.failOnDefault, tc.failOnView, w.Code, w.Body.String(), tc.status, tc.body)
+		}
+	}
+}
+
+// acceptJSON sets the Accept header of the request to application/json.
+func acceptJSON(r *http.Request) {
+	r.Header.Set("Accept", "application/json")
+}
+
+func TestUserErrorEscaping(t *testing.T) {
+	files := map[string]string{"errors.html": `{{ define "content" }}{{ range .errors }}{{ . }}{{ end }}{{ end }}`}
+	script := "<script>alert(1)</script>"
+
+	rnd := newRender(t, files, NegotiateJSON(true), RawErrors(true))
+	handler := rnd("errors", userError(script))
+	if body := get(handler).Body.String(); body != "<html>&lt;script&gt;alert(1)&lt;/script&gt;</html>" {
+		t.Errorf("html body is %q", body)
+	}
+	if body := get(handler, acceptJSON).Body.String(); body != `{"errors":["\u003cscript\u003ealert(1)\u003c/script\u003e"]}`+"\n" {
+		t.Errorf("json body is %q", body)
+	}
+
+	rnd = newRender(t, files, NegotiateJSON(true), RawErrors(true), JSONEscapeHTML(false))
+	if body := get(rnd("errors", userError(script)), acceptJSON).Body.String(); body != `{"errors":["<script>alert(1)</script>"]}`+"\n" {
+		t.Errorf("unescaped json body is %q", body)
+	}
+}
+
+func TestPreview(t *testing.T) {
+	fixture := filepath.Join(t.TempDir(), "home.json")
+	if err := ioutil.WriteFile(fixture, []byte(`{"hello": "fixture"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	rnd := newRender(t, nil, DisableCache(true))
+	if body := get(rnd.Preview("home", fixture)).Body.String(); body != "<html>hello fixture</html>" {
+		t.Errorf("body is %q", body)
+	}
+
+	rnd = newRender(t, nil)
+	if w := get(rnd.Preview("home", fixture)); w.Code != http.StatusNotFound {
+		t.Errorf("status with the cache enabled is %d, want 404", w.Code)
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	logs := captureLog(t)
+	rnd := newRender(t, map[string]string{"id.html": `{{ define "content" }}{{ .request_id }}{{ end }}`},
+		RequestID("", "request_id"))
+	handler := rnd("id", userError("failed"))
+
+	w := get(handler, func(r *http.Request) { r.Header.Set("X-Request-ID", "req-42") })
+	if body := w.Body.String(); body != "<html>req-42</html>" {
+		t.Errorf("body is %q", body)
+	}
+	if !strings.Contains(logs.String(), "[req-42] user error => renderlayout:data") {
+		t.Errorf("the log isn't prefixed with the request id: %s", logs)
+	}
+
+	logs.Reset()
+	id := strings.TrimSuffix(strings.TrimPrefix(get(handler).Body.String(), "<html>"), "</html>")
+	if _, err := uuid.Parse(id); err != nil {
+		t.Errorf("the generated request id %q isn't a uuid", id)
+	}
+	if !strings.Contains(logs.String(), "["+id+"]") {
+		t.Errorf("the log isn't prefixed with the generated request id %s: %s", id, logs)
+	}
+}
+
+func TestReload(t *testing.T) {
+	root := writeTemplates(t, map[string]string{"more.html": `{{ define "content" }}{{ template "extra" . }}{{ end }}`})
+	rnd, err := New(TemplatesPath(root))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body := get(rnd("home", data(D{"hello": "world"}))).Body.String(); body != "<html>hello world</html>" {
+		t.Fatalf("body is %q", body)
+	}
+	writeFiles(t, root, map[string]string{"partials/extra.html": `{{ define "extra" }}extra{{ end }}`})
+	if body := get(rnd("more")).Body.String(); body != "Something went wrong." {
+		t.Fatalf("body before Reload is %q, want the render error", body)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				if w := get(rnd("home", data(D{"hello": "world"}))); w.Code != http.StatusOK {
+					t.Errorf("status of a render during Reload is %d", w.Code)
+				}
+			}
+		}()
+	}
+	if err := rnd.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+	if body := get(rnd("more")).Body.String(); body != "<html>extra</html>" {
+		t.Errorf("body after Reload is %q", body)
+	}
+}
+
+func TestRenderFragment(t *testing.T) {
+	rnd := newRender(t, map[string]string{"event.html": `<p>{{ .msg }}</p>`})
+	b, err := rnd.RenderFragment("home", D{"hello": "world"})
+	if err != nil || string(b) != "hello world" {
+		t.Errorf("content block is %q, %v", b, err)
+	}
+	b, err = rnd.RenderFragment("event", D{"msg": "<ping>"})
+	if err != nil || string(b) != "<p>&lt;ping&gt;</p>" {
+		t.Errorf("view is %q, %v", b, err)
+	}
+	if _, err := rnd.RenderFragment("missing", nil); err == nil {
+		t.Error("the fragment of a missing view didn't fail")
+	}
+}
+
+func TestJSONOptions(t *testing.T) {
+	viewData := data(D{"html": "<b>"})
+	for _, tc := range []struct {
+		opts []Option
+		want string
+	}{
+		{nil, `{"html":"\u003cb\u003e"}` + "\n"},
+		{[]Option{JSONIndent(true)}, "{\n  \"html\": \"\\u003cb\\u003e\"\n}\n"},
+		{[]Option{JSONEscapeHTML(false)}, `{"html":"<b>"}` + "\n"},
+	} {
+		rnd := newRender(t, nil, append([]Option{NegotiateJSON(true)}, tc.opts...)...)
+		w := get(rnd("home", viewData), acceptJSON)
+		if body := w.Body.String(); body != tc.want {
+			t.Errorf("body is %q, want %q", body, tc.want)
+		}
+		if contentType := w.Header().Get("Content-Type"); contentType != "application/json; charset=utf-8" {
+			t.Errorf("content type is %q", contentType)
+		}
+	}
+}
+
+func TestViewsPath(t *testing.T) {
+	rnd := newRender(t, map[string]string{
+		"pages/about.html": `{{ define "content" }}about {{ .hello }}{{ end }}`,
+	}, ViewsPath("/pages/"))
+	if body := get(rnd("about", data(D{"hello": "us"}))).Body.String(); body != "<html>about us</html>" {
+		t.Errorf("body is %q", body)
+	}
+	logs := captureLog(t)
+	for _, view := range []string{"home", "../home"} {
+		if body := get(rnd(view)).Body.String(); body != "Something went wrong." {
+			t.Errorf("view %s outside the views path is %q", view, body)
+		}
+	}
+	if !strings.Contains(logs.String(), "view [../home] is outside the views path pages") {
+		t.Errorf("log is %q", logs.String())
+	}
+}
+
+// fieldError is a FieldError of a form field.
+type fieldError struct {
+	field, code string
+}
+
+func (e fieldError) Error() string { return e.field + " is " + e.code }
+func (e fieldError) Field() string { return e.field }
+func (e fieldError) Code() string  { return e.code }
+
+func TestStructuredErrors(t *testing.T) {
+	rnd := newRender(t, map[string]string{
+		"form.html": `{{ define "content" }}{{ range .errors }}{{ if eq (printf "%T" .) "string" }}[{{ . }}]` +
+			`{{ else }}[{{ .Field }} {{ .Code }}: {{ .Message }}]{{ end }}{{ end }}{{ end }}`,
+	}, StructuredErrors(true), RawErrors(true))
+	invalid := func(w http.ResponseWriter, r *http.Request) (D, error) {
+		return nil, fieldError{field: "email", code: "required"}
+	}
+	body := get(rnd("form", invalid, userError("try again"))).Body.String()
+	if body != "<html>[email required: email is required][try again]</html>" {
+		t.Errorf("body is %q", body)
+	}
+}
+
+func TestCombine(t *testing.T) {
+	rnd := newRender(t, map[string]string{
+		"combined.html": `{{ define "content" }}{{ .a }} {{ .b }} {{ range .errors }}[{{ . }}]{{ end }}{{ end }}`,
+	})
+	combined := Combine(data(D{"a": "first", "b": "first"}), userError("no b"), data(D{"b": "second"}))
+	if body := get(rnd("combined", combined)).Body.String(); body != "<html>first second [No b]</html>" {
+		t.Errorf("body is %q", body)
+	}
+}
+
+func TestRespond(t *testing.T) {
+	rnd := newRender(t, map[string]string{
+		"missing.html": `{{ define "content" }}missing {{ .hello }}{{ end }}`,
+	})
+	w := get(rnd.Respond(http.StatusNotFound, map[string]string{"X-Reason": "gone"}, "missing", data(D{"hello": "world"})))
+	if w.Code != http.StatusNotFound || w.Header().Get("X-Reason") != "gone" {
+		t.Errorf("response is %d %v", w.Code, w.Header())
+	}
+	if body := w.Body.String(); body != "<html>missing world</html>" {
+		t.Errorf("body is %q", body)
+	}
+}
+
+func TestLayoutData(t *testing.T) {
+	rnd := newRender(t, map[string]string{
+		"layouts/index.html": `<nav>{{ .layout.nav }} {{ .layout.user }}</nav>{{ template "content" . }}`,
+		"page.html":          `{{ define "content" }}{{ .hello }} {{ .nav }}{{ end }}`,
+	})
+	body := get(rnd("page", LayoutData(data(D{"nav": "home", "user": "guest"})), data(D{"hello": "world"}),
+		LayoutData(data(D{"user": "admin"})))).Body.String()
+	if body != "<nav>home admin</nav>world " {
+		t.Errorf("body is %q", body)
+	}
+}
+
+func TestStrictKeys(t *testing.T) {
+	reserved := data(D{"errors": "mine", "hello": "world"})
+	logs := captureLog(t)
+	rnd := newRender(t, nil, Debug(true))
+	if body := get(rnd("home", reserved)).Body.String(); body != "<html>hello world</html>" {
+		t.Errorf("debug body is %q", body)
+	}
+	if !strings.Contains(logs.String(), `warning => renderlayout:data => returned the reserved key "errors"`) {
+		t.Errorf("log is %q, want the reserved key warning", logs.String())
+	}
+
+	rnd = newRender(t, nil, StrictKeys(true))
+	if w := get(rnd("home", reserved)); w.Code != http.StatusInternalServerError || w.Body.String() != "Something went wrong." {
+		t.Errorf("StrictKeys response is %d %q", w.Code, w.Body.String())
+	}
+	if w := get(rnd("home", data(D{"hello": "world"}))); w.Code != http.StatusOK {
+		t.Errorf("StrictKeys response without reserved keys is %d %q", w.Code, w.Body.String())
+	}
+}
+
+func TestRenderInline(t *testing.T) {
+	rnd := newRender(t, nil)
+	out, err := rnd.RenderInline(`{{ upper .hello }} {{ template "main" }}`, D{"hello": "world"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out != "WORLD main" {
+		t.Errorf("output is %q", out)
+	}
+	if _, err := rnd.RenderInline(`{{ .hello`, nil); err == nil {
+		t.Error("an invalid template renders")
+	}
+}
+
+func TestManifest(t *testing.T) {
+	dir := t.TempDir()
+	manifest := filepath.Join(dir, "manifest.json")
+	writeFiles(t, dir, map[string]string{
+		"manifest.json": `{"app.js": "assets/app.4889e940.js", "app.css": {"file": "assets/app.1b2c3d4e.css"}}`,
+	})
+	files := map[string]string{"assets.html": `{{ define "content" }}{{ manifest "app.js" }} {{ manifest "app.css" }}{{ end }}`}
+	rnd := newRender(t, files, Manifest(manifest), DisableCache(true))
+	if body := get(rnd("assets")).Body.String(); body != "<html>assets/app.4889e940.js assets/app.1b2c3d4e.css</html>" {
+		t.Errorf("body is %q", body)
+	}
+
+	writeFiles(t, dir, map[string]string{"manifest.json": `{"app.js": "assets/app.5f6a7b8c.js", "app.css": "app.css"}`})
+	if body := get(rnd("assets")).Body.String(); body != "<html>assets/app.5f6a7b8c.js app.css</html>" {
+		t.Errorf("body with the cache disabled is %q, want the reloaded manifest", body)
+	}
+
+	if _, err := New(TemplatesPath(writeTemplates(t, files)), Manifest(filepath.Join(dir, "missing.json"))); err == nil {
+		t.Error("New succeeds with a missing manifest")
+	}
+}
+
+func TestNoContent(t *testing.T) {
+	rnd := newRender(t, nil)
+	rendered := false
+	noContent := func(w http.ResponseWriter, r *http.Request) (D, error) {
+		return nil, NoContent()
+	}
+	after := func(w http.ResponseWriter, r *http.Request) (D, error) {
+		rendered = true
+		return nil, nil
+	}
+	w := get(rnd("home", noContent, after))
+	if w.Code != http.StatusNoContent || w.Body.Len() != 0 {
+		t.Errorf("response is %d %q, want an empty 204", w.Code, w.Body.String())
+	}
+	if rendered {
+		t.Error("the data funcs after NoContent ran")
+	}
+}
+
+// span is a span started by fakeTracer.
+type span struct {
+	name  string
+	attrs map[string]string
+	ended bool
+	err   error
+}
+
+// fakeTracer records the spans started with Trace.
+type fakeTracer struct {
+	spans []*span
+}
+
+type spanKey struct{}
+
+func (tr *fakeTracer) start(ctx context.Context, name string, attrs map[string]string) (context.Context, func(err error)) {
+	s := &span{name: name, attrs: attrs}
+	tr.spans = append(tr.spans, s)
+	return context.WithValue(ctx, spanKey{}, s), func(err error) {
+		s.ended = true
+		s.err = err
+	}
+}
+
+func TestTrace(t *testing.T) {
+	tracer := &fakeTracer{}
+	rnd := newRender(t, nil, Trace(tracer.start))
+	var dataSpan interface{}
+	spanData := func(w http.ResponseWriter, r *http.Request) (D, error) {
+		dataSpan = r.Context().Value(spanKey{})
+		return D{"hello": "world"}, nil
+	}
+	if body := get(rnd("home", spanData)).Body.String(); body != "<html>hello world</html>" {
+		t.Errorf("body is %q", body)
+	}
+	if len(tracer.spans) != 2 {
+		t.Fatalf("spans are %v, want the data and render spans", tracer.spans)
+	}
+	for i, name := range []string{"renderlayout.data", "renderlayout.render"} {
+		s := tracer.spans[i]
+		if s.name != name || s.attrs["view"] != "home" || s.attrs["layout"] != "index" || !s.ended || s.err != nil {
+			t.Errorf("span %d is %+v, want an ended %s span of the home view", i, s, name)
+		}
+	}
+	if tracer.spans[1].attrs["status"] != "200" {
+		t.Errorf("render span attributes are %v", tracer.spans[1].attrs)
+	}
+	if dataSpan != tracer.spans[0] {
+		t.Error("the data funcs don't get the context of the data span")
+	}
+
+	tracer.spans = nil
+	get(rnd("missing"))
+	if s := tracer.spans[len(tracer.spans)-1]; !s.ended || s.err == nil {
+		t.Errorf("render span of a missing view is %+v, want its error", s)
+	}
+}
+
+func TestCacheControl(t *testing.T) {
+	rnd := newRender(t, map[string]string{"broken.html": `{{ define "content" }}{{ .hello.missing }}{{ end }}`})
+	for _, tc := range []struct {
+		cache interface{}
+		want  string
+	}{
+		{CacheControl{MaxAge: 60, Public: true}, "public, max-age=60"},
+		{&CacheControl{NoCache: true, MustRevalidate: true}, "no-cache, must-revalidate"},
+		{CacheControl{NoStore: true}, "no-store, max-age=0"},
+		{nil, ""},
+	} {
+		w := get(rnd("home", data(D{"hello": "world", "_cache": tc.cache})))
+		if got := w.Header().Get("Cache-Control"); got != tc.want {
+			t.Errorf("Cache-Control of %v is %q, want %q", tc.cache, got, tc.want)
+		}
+		if body := w.Body.String(); w.Code != http.StatusOK || body != "<html>hello world</html>" {
+			t.Errorf("response of %v is %d %q", tc.cache, w.Code, body)
+		}
+	}
+	if got := get(rnd("home", Private())).Header().Get("Cache-Control"); got != "no-store, max-age=0" {
+		t.Errorf("Private Cache-Control is %q", got)
+	}
+
+	w := get(rnd("broken", data(D{"hello": 42, "_cache": CacheControl{MaxAge: 60}, "_surrogate_keys": []string{"p1"}})))
+	if w.Code != http.StatusInternalServerError || w.Body.String() != "Something went wrong." {
+		t.Errorf("failed render response is %d %q, want a 500", w.Code, w.Body.String())
+	}
+	if w.Header().Get("Cache-Control") != "" || w.Header().Get("Surrogate-Key") != "" {
+		t.Errorf("failed render headers are %v, want no cache headers", w.Header())
+	}
+}
+
+func TestRenderAll(t *testing.T) {
+	files := map[string]string{"layouts/index.html": `<html>{{ template "content" . }}{{ template "main" . }}</html>`}
+	pages := make(map[string]D)
+	for i := 0; i < 20; i++ {
+		view := fmt.Sprintf("page%d", i)
+		files[view+".html"] = fmt.Sprintf(`{{ define "content" }}%d {{ .hello }} {{ upper .hello }}{{ end }}`, i)
+		pages[view] = D{"hello": view}
+	}
+	pages["missing"] = nil
+	rnd := newRender(t, files)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rendered, err := rnd.RenderAll(pages)
+			if err == nil || !strings.Contains(err.Error(), "render view [missing]") {
+				t.Errorf("error is %v, want the missing view's", err)
+			}
+			if len(rendered) != 20 {
+				t.Errorf("rendered %d views, want 20", len(rendered))
+			}
+			for j := 0; j < 20; j++ {
+				view := fmt.Sprintf("page%d", j)
+				want := fmt.Sprintf("<html>%d %s %smain</html>", j, view, strings.ToUpper(view))
+				if got := string(rendered[view]); got != want {
+					t.Errorf("view %s is %q, want %q", view, got, want)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestJSONErrorKey(t *testing.T) {
+	for _, tc := range []struct {
+		key, want string
+	}{
+		{"", `{"errors":["Invalid"],"hello":"world"}` + "\n"},
+		{"error", `{"error":["Invalid"],"hello":"world"}` + "\n"},
+		{"error.details", `{"error":{"details":["Invalid"]},"hello":"world"}` + "\n"},
+	} {
+		rnd := newRender(t, nil, NegotiateJSON(true), JSONErrorKey(tc.key))
+		if body := get(rnd("home", data(D{"hello": "world"}), userError("invalid")), acceptJSON).Body.String(); body != tc.want {
+			t.Errorf("JSONErrorKey(%q) body is %q, want %q", tc.key, body, tc.want)
+		}
+		if body := get(rnd("home", data(D{"hello": "world"}), userError("invalid"))).Body.String(); body != "<html>hello world</html>" {
+			t.Errorf("JSONErrorKey(%q) html body is %q", tc.key, body)
+		}
+	}
+
+	meta := data(D{"hello": "world", "meta": D{"page": 2}, "links": map[string]interface{}{"next": "/3"}})
+	for _, tc := range []struct {
+		key, want string
+	}{
+		{"meta.errors", `{"hello":"world","links":{"next":"/3"},"meta":{"errors":["Invalid"],"page":2}}` + "\n"},
+		{"links.meta.errors", `{"hello":"world","links":{"meta":{"errors":["Invalid"]},"next":"/3"},"meta":{"page":2}}` + "\n"},
+	} {
+		rnd := newRender(t, nil, NegotiateJSON(true), JSONErrorKey(tc.key))
+		if body := get(rnd("home", meta, userError("invalid")), acceptJSON).Body.String(); body != tc.want {
+			t.Errorf("JSONErrorKey(%q) body with the objects is %q, want %q", tc.key, body, tc.want)
+		}
+	}
+	logs := captureLog(t)
+	rnd := newRender(t, nil, NegotiateJSON(true), JSONErrorKey("hello.errors"))
+	if w := get(rnd("home", meta, userError("invalid")), acceptJSON); w.Code != http.StatusInternalServerError {
+		t.Errorf("JSONErrorKey through a string is %d %q", w.Code, w.Body.String())
+	}
+	if !strings.Contains(logs.String(), "json error key [hello.errors] => hello isn't an object") {
+		t.Errorf("log is %q, want the invalid key", logs.String())
+	}
+}
+
+func TestPrivate(t *testing.T) {
+	rnd := newRender(t, nil)
+	if got := get(rnd("home", Private())).Header().Get("Cache-Control"); got != "no-store, max-age=0" {
+		t.Errorf("private Cache-Control is %q", got)
+	}
+	if got := get(rnd("home")).Header().Get("Cache-Control"); got != "" {
+		t.Errorf("public Cache-Control is %q, want none", got)
+	}
+	if got := get(rnd("home", Private(), data(D{"_cache": CacheControl{Private: true, MaxAge: 30}}))).Header().Get("Cache-Control"); got != "private, max-age=30" {
+		t.Errorf("overridden Cache-Control is %q", got)
+	}
+}
+
+func TestRenderEmail(t *testing.T) {
+	rnd := newRender(t, map[string]string{
+		"emails/welcome.html": `{{ define "content" }}<p>Hi {{ .name }}</p>{{ end }}`,
+		"emails/welcome.txt":  `Hi {{ .name }}`,
+	})
+	user := D{"name": "Tom & <Jerry>"}
+	html, text, err := rnd.RenderEmail("emails/welcome", "emails/welcome.txt", user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if html != "<html><p>Hi Tom &amp; &lt;Jerry&gt;</p></html>" {
+		t.Errorf("html part is %q", html)
+	}
+	if text != "Hi Tom & <Jerry>" {
+		t.Errorf("text part is %q", text)
+	}
+
+	html, text, err = rnd.RenderEmail("", "emails/welcome.txt", user)
+	if err != nil || html != "" || text != "Hi Tom & <Jerry>" {
+		t.Errorf("text only email is %q %q %v", html, text, err)
+	}
+	if _, _, err := rnd.RenderEmail("emails/missing", "", user); err == nil {
+		t.Error("an email with a missing view renders")
+	}
+}
+
+func TestAddDynamicFuncs(t *testing.T) {
+	var mu sync.Mutex
+	beta := false
+	rnd := newRender(t, map[string]string{"flags.html": `{{ define "content" }}beta {{ beta }}{{ end }}`},
+		AddDynamicFuncs(func() template.FuncMap {
+			mu.Lock()
+			enabled := beta
+			mu.Unlock()
+			return template.FuncMap{"beta": func() bool { return enabled }}
+		}))
+	handler := rnd("flags")
+	if body := get(handler).Body.String(); body != "<html>beta false</html>" {
+		t.Errorf("body is %q", body)
+	}
+	mu.Lock()
+	beta = true
+	mu.Unlock()
+	if body := get(handler).Body.String(); body != "<html>beta true</html>" {
+		t.Errorf("body after the flag changed is %q", body)
+	}
+}
+
+func TestWriteGuard(t *testing.T) {
+	logs := captureLog(t)
+	rnd := newRender(t, nil)
+	writes := func(w http.ResponseWriter, r *http.Request) (D, error) {
+		http.Error(w, "teapot", http.StatusTeapot)
+		return D{"hello": "world"}, nil
+	}
+	w := get(rnd("home", writes))
+	if w.Code != http.StatusTeapot || w.Body.String() != "teapot\n" {
+		t.Errorf("response is %d %q, want the data func's", w.Code, w.Body.String())
+	}
+	if !strings.Contains(logs.String(), "renderlayout:render view [home] => skipped, the response was written by a data func") {
+		t.Errorf("log is %q, want the skipped render warning", logs.String())
+	}
+}
+
+func TestSnapshotDir(t *testing.T) {
+	files := map[string]string{"account/settings.html": `{{ define "content" }}settings of {{ .name }}{{ end }}`}
+	dir := t.TempDir()
+	captureLog(t)
+	rnd := newRender(t, files, Debug(true), SnapshotDir(dir))
+	if body := get(rnd("account/settings", data(D{"name": "ann"}))).Body.String(); body != "<html>settings of ann</html>" {
+		t.Errorf("body is %q", body)
+	}
+	snapshot, err := ioutil.ReadFile(filepath.Join(dir, "account_settings.snap"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "view: account/settings\ndata:\n{\n  \"name\": \"ann\"\n}\noutput:\n<html>settings of ann</html>"
+	if string(snapshot) != want {
+		t.Errorf("snapshot is %q, want %q", snapshot, want)
+	}
+
+	dir = t.TempDir()
+	rnd = newRender(t, files, SnapshotDir(dir))
+	get(rnd("account/settings", data(D{"name": "ann"})))
+	if entries, _ := ioutil.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("snapshots are written outside of debug mode: %v", entries)
+	}
+}
+
+func TestLayoutPartials(t *testing.T) {
+	files := map[string]string{
+		"layouts/app.html":            `<app>{{ template "content" . }}</app>`,
+		"partials/admin_toolbar.html": `{{ define "admin_toolbar" }}toolbar{{ end }}`,
+		"admin.html":                  `{{ define "content" }}{{ template "admin_toolbar" . }} {{ template "main" . }}{{ end }}`,
+	}
+	scoped := LayoutPartials(map[string][]string{"app": {"admin_toolbar"}})
+	rnd := newRender(t, files, scoped, Layout("app"))
+	if body := get(rnd("admin")).Body.String(); body != "<app>toolbar main</app>" {
+		t.Errorf("app layout body is %q", body)
+	}
+	captureLog(t)
+	rnd = newRender(t, files, scoped)
+	if body := get(rnd("admin")).Body.String(); body != "Something went wrong." {
+		t.Errorf("index layout body is %q, want the render error", body)
+	}
+}
+
+func TestCacheStats(t *testing.T) {
+	files := map[string]string{
+		"partials/greet.html": `<i>{{ .hello }}</i>`,
+		"greet.html":          `{{ define "content" }}{{ include "partials/greet" }}{{ end }}`,
+	}
+	rnd := newRender(t, files)
+	get(rnd("home"))
+	if stats := rnd.CacheStats(); stats != (CacheStats{Misses: 1, Size: 1}) {
+		t.Errorf("stats after the first render are %+v", stats)
+	}
+	get(rnd("home"))
+	if stats := rnd.CacheStats(); stats != (CacheStats{Hits: 1, Misses: 1, Size: 1}) {
+		t.Errorf("stats after the second render are %+v", stats)
+	}
+	get(rnd("greet"))
+	get(rnd("greet"))
+	if stats := rnd.CacheStats(); stats != (CacheStats{Hits: 3, Misses: 3, Size: 3}) {
+		t.Errorf("stats with an included partial are %+v, want it counted once per render", stats)
+	}
+
+	for name, opts := range map[string][]Option{
+		"html": {DisableCache(true)},
+		"text": {DisableCache(true), TextMode(true)},
+	} {
+		rnd = newRender(t, files, opts...)
+		get(rnd("greet"))
+		get(rnd("greet"))
+		if stats := rnd.CacheStats(); stats != (CacheStats{}) {
+			t.Errorf("%s stats with the cache disabled are %+v", name, stats)
+		}
+	}
+}
+
+func TestRequirePartials(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{
+		"layouts/index.html": `<html>{{ template "content" . }}</html>`,
+		"partials/README.md": `partials of the app`,
+		"home.html":          `{{ define "content" }}home{{ end }}`,
+	})
+	if _, err := New(TemplatesPath(root)); err != nil {
+		t.Errorf("New without partials fails: %v", err)
+	}
+	if _, err := New(TemplatesPath(root), RequirePartials(true)); err == nil {
+		t.Error("New without partials succeeds with RequirePartials")
+	}
+	if _, err := New(TemplatesPath(writeTemplates(t, nil)), RequirePartials(true)); err != nil {
+		t.Errorf("New with a partial fails with RequirePartials: %v", err)
+	}
+}
+
+func TestWithView(t *testing.T) {
+	rnd := newRender(t, map[string]string{"about.html": `{{ define "content" }}about{{ end }}`})
+	variant := rnd.WithView("home", `{{ define "content" }}variant {{ upper .hello }} {{ template "main" . }}{{ end }}`)
+	if body := get(variant("home", data(D{"hello": "world"}))).Body.String(); body != "<html>variant WORLD main</html>" {
+		t.Errorf("overridden view body is %q", body)
+	}
+	if body := get(variant("about")).Body.String(); body != "<html>about</html>" {
+		t.Errorf("other view body is %q", body)
+	}
+	if body := get(rnd("home", data(D{"hello": "world"}))).Body.String(); body != "<html>hello world</html>" {
+		t.Errorf("original view body is %q", body)
+	}
+}
+
+// user is the typed value shared by a WithContext data func.
+type user struct {
+	name string
+}
+
+type userKey struct{}
+
+func TestWithContext(t *testing.T) {
+	withUser := WithContext(func(w http.ResponseWriter, r *http.Request) (D, context.Context, error) {
+		return D{"signedIn": true}, context.WithValue(r.Context(), userKey{}, &user{name: "ann"}), nil
+	})
+	greeting := func(w http.ResponseWriter, r *http.Request) (D, error) {
+		u, _ := r.Context().Value(userKey{}).(*user)
+		if u == nil {
+			return D{"hello": "guest"}, nil
+		}
+		return D{"hello": u.name}, nil
+	}
+	files := map[string]string{"layouts/index.html": `<html>{{ .signedIn }} {{ .layout.signedIn }} {{ template "content" . }}</html>`}
+
+	rnd := newRender(t, files, DefaultData(withUser))
+	if body := get(rnd("home", greeting)).Body.String(); body != "<html>true  hello ann</html>" {
+		t.Errorf("DefaultData body is %q", body)
+	}
+
+	rnd = newRender(t, files)
+	w := get(rnd("home", LayoutData(withUser, Private()), greeting))
+	if body := w.Body.String(); body != "<html> true hello ann</html>" {
+		t.Errorf("LayoutData body is %q", body)
+	}
+	if got := w.Header().Get("Cache-Control"); got != "no-store, max-age=0" {
+		t.Errorf("LayoutData Cache-Control is %q", got)
+	}
+	if body := get(rnd("home", greeting)).Body.String(); body != "<html>  hello guest</html>" {
+		t.Errorf("body without the context is %q", body)
+	}
+}
+
+func TestPartialsManifest(t *testing.T) {
+	files := map[string]string{
+		"partials/banner.html":       `{{ define "banner" }}banner{{ end }}`,
+		"partials/banner_promo.html": `{{ define "banner" }}promo{{ end }}`,
+		"partials/experiment.html":   `{{ define "experiment" }}experiment{{ end }}`,
+		"banner.html":                `{{ define "content" }}{{ template "banner" . }}{{ end }}`,
+		"trial.html":                 `{{ define "content" }}{{ template "experiment" . }}{{ end }}`,
+	}
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"partials.txt":  "# partials\nmain\nbanner_promo.html\n\npartials/banner\n",
+		"partials.json": `["banner", "banner_promo"]`,
+	})
+	for _, tc := range []struct {
+		manifest, banner string
+		partials         []string
+	}{
+		{"partials.txt", "banner", []string{"partials/main", "partials/banner_promo", "partials/banner"}},
+		{"partials.json", "promo", []string{"partials/banner", "partials/banner_promo"}},
+	} {
+		rnd := newRender(t, files, PartialsManifest(filepath.Join(dir, tc.manifest)))
+		if partials := rnd.renderer().engine().config.Partials; !reflect.DeepEqual(partials, tc.partials) {
+			t.Errorf("partials of %s are %v, want %v", tc.manifest, partials, tc.partials)
+		}
+		if body := get(rnd("banner")).Body.String(); body != "<html>"+tc.banner+"</html>" {
+			t.Errorf("banner of %s is %q", tc.manifest, body)
+		}
+		captureLog(t)
+		if body := get(rnd("trial")).Body.String(); body != "Something went wrong." {
+			t.Errorf("unlisted partial of %s renders %q", tc.manifest, body)
+		}
+	}
+}
+
+func TestLayoutSelector(t *testing.T) {
+	rnd := newRender(t, map[string]string{"layouts/app.html": `<app>{{ template "content" . }}</app>`},
+		LayoutSelector(func(r *http.Request) string {
+			if r.Header.Get("X-User") != "" {
+				return "app"
+			}
+			return ""
+		}))
+	handler := rnd("home", data(D{"hello": "world"}))
+	if body := get(handler, func(r *http.Request) { r.Header.Set("X-User", "ann") }).Body.String(); body != "<app>hello world</app>" {
+		t.Errorf("signed in body is %q", body)
+	}
+	if body := get(handler).Body.String(); body != "<html>hello world</html>" {
+		t.Errorf("guest body is %q", body)
+	}
+}
+
+// errMissingName is the user error of a form without a name.
+var errMissingName = errors.New("name is required")
+
+func TestErrorTranslator(t *testing.T) {
+	files := map[string]string{"errors.html": `{{ define "content" }}{{ range .errors }}[{{ . }}]{{ end }}{{ end }}`}
+	rnd := newRender(t, files, ErrorTranslator(func(r *http.Request, err error) string {
+		if errors.Is(err, errMissingName) && r.Header.Get("Accept-Language") == "fr" {
+			return "le nom est obligatoire"
+		}
+		return ""
+	}))
+	missingName := func(w http.ResponseWriter, r *http.Request) (D, error) {
+		return nil, fmt.Errorf("validating, %w", errMissingName)
+	}
+	french := func(r *http.Request) { r.Header.Set("Accept-Language", "fr") }
+	if body := get(rnd("errors", missingName, userError("try again")), french).Body.String(); body != "<html>[le nom est obligatoire][Try again]</html>" {
+		t.Errorf("translated body is %q", body)
+	}
+	if body := get(rnd("errors", missingName)).Body.String(); body != "<html>[Name is required]</html>" {
+		t.Errorf("untranslated body is %q", body)
+	}
+}
+
+// flushRecorder is a ResponseRecorder recording the body written at every flush.
+type flushRecorder struct {
+	*httptest.ResponseRecorder
+	flushed []string
+}
+
+func (f *flushRecorder) Flush() {
+	f.flushed = append(f.flushed, f.Body.String())
+	f.ResponseRecorder.Flush()
+}
+
+func TestStreaming(t *testing.T) {
+	files := map[string]string{
+		"layouts/index.html": `<head></head><nav></nav>{{ flush }}<main>{{ template "content" . }}</main>`,
+	}
+	for _, opts := range [][]Option{
+		{Streaming(true)},
+		{Streaming(true), ReplaceFuncs(template.FuncMap{})},
+	} {
+		rnd := newRender(t, files, opts...)
+		w := &flushRecorder{ResponseRecorder: httptest.NewRecorder()}
+		rnd("home", data(D{"hello": "world"}))(w, httptest.NewRequest(http.MethodGet, "/", nil))
+		if body := w.Body.String(); body != "<head></head><nav></nav><main>hello world</main>" {
+			t.Errorf("body is %q", body)
+		}
+		if len(w.flushed) != 1 || w.flushed[0] != "<head></head><nav></nav>" {
+			t.Errorf("flushed %q, want the head and nav before the content", w.flushed)
+		}
+	}
+
+	rnd := newRender(t, files, AfterRender(func(r *http.Request, body []byte) []byte { return body }), Streaming(true))
+	w := &flushRecorder{ResponseRecorder: httptest.NewRecorder()}
+	rnd("home", data(D{"hello": "world"}))(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	if len(w.flushed) != 0 || w.Body.String() != "<head></head><nav></nav><main>hello world</main>" {
+		t.Errorf("buffered render flushed %q with body %q", w.flushed, w.Body.String())
+	}
+}
+
+func TestMaxConcurrentRenders(t *testing.T) {
+	for _, reject := range []bool{true, false} {
+		started, unblock := make(chan struct{}), make(chan struct{})
+		rnd := newRender(t, map[string]string{"slow.html": `{{ define "content" }}{{ wait }}slow{{ end }}`},
+			MaxConcurrentRenders(1, reject),
+			AddFuncs(template.FuncMap{"wait": func() string {
+				started <- struct{}{}
+				<-unblock
+				return ""
+			}}))
+		slow := make(chan *httptest.ResponseRecorder)
+		go func() {
+			slow <- get(rnd("slow"))
+		}()
+		<-started
+
+		if reject {
+			captureLog(t)
+			if w := get(rnd("home")); w.Code != http.StatusServiceUnavailable || w.Body.String() != "Something went wrong." {
+				t.Errorf("response beyond the limit is %d %q, want a 503", w.Code, w.Body.String())
+			}
+			close(unblock)
+		} else {
+			queued := make(chan *httptest.ResponseRecorder)
+			go func() {
+				queued <- get(rnd("home", data(D{"hello": "world"})))
+			}()
+			select {
+			case w := <-queued:
+				t.Errorf("render beyond the limit didn't wait: %d %q", w.Code, w.Body.String())
+			case <-time.After(50 * time.Millisecond):
+			}
+			close(unblock)
+			if w := <-queued; w.Code != http.StatusOK || w.Body.String() != "<html>hello world</html>" {
+				t.Errorf("queued response is %d %q", w.Code, w.Body.String())
+			}
+		}
+		if w := <-slow; w.Code != http.StatusOK || w.Body.String() != "<html>slow</html>" {
+			t.Errorf("MaxConcurrentRenders(1, %v) response within the limit is %d %q", reject, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestRequireKeys(t *testing.T) {
+	files := map[string]string{"checkout.html": `{{ define "content" }}{{ .cart }} {{ .total }}{{ end }}`}
+	logs := captureLog(t)
+	rnd := newRender(t, files, RequireKeys("checkout", "cart", "total"))
+	if w := get(rnd("checkout", data(D{"cart": "3 items"}))); w.Code != http.StatusOK || w.Body.String() != "<html>3 items </html>" {
+		t.Errorf("response is %d %q", w.Code, w.Body.String())
+	}
+	if !strings.Contains(logs.String(), `warning => renderlayout:render view [checkout] => missing the required keys ["total"]`) {
+		t.Errorf("log is %q, want the missing key warning", logs.String())
+	}
+	logs.Reset()
+	get(rnd("checkout", data(D{"cart": "3 items", "total": 42})))
+	get(rnd("home"))
+	if strings.Contains(logs.String(), "warning") {
+		t.Errorf("log is %q, want no warning", logs.String())
+	}
+
+	rnd = newRender(t, files, RequireKeys("checkout", "cart", "total"), StrictKeys(true))
+	if w := get(rnd("checkout", data(D{"cart": "3 items"}))); w.Code != http.StatusInternalServerError {
+		t.Errorf("StrictKeys response is %d %q, want a 500", w.Code, w.Body.String())
+	}
+}
+
+func TestRawResponse(t *testing.T) {
+	rnd := newRender(t, nil)
+	cached := func(w http.ResponseWriter, r *http.Request) (D, error) {
+		return nil, RawResponse("text/html; charset=utf-8", []byte("<p>cached {{ .hello }}</p>"))
+	}
+	w := get(rnd("home", cached, data(D{"hello": "world"})))
+	if w.Code != http.StatusOK || w.Body.String() != "<p>cached {{ .hello }}</p>" {
+		t.Errorf("response is %d %q, want the raw body", w.Code, w.Body.String())
+	}
+	if contentType := w.Header().Get("Content-Type"); contentType != "text/html; charset=utf-8" {
+		t.Errorf("content type is %q", contentType)
+	}
+}
+
+func TestLogRequestOnError(t *testing.T) {
+	request := func(r *http.Request) {
+		r.URL.Path = "/account"
+		r.URL.RawQuery = "tab=billing"
+		r.Header.Set("User-Agent", "tester")
+		r.Header.Set("Cookie", "session=secret")
+	}
+	for _, enable := range []bool{false, true} {
+		logs := captureLog(t)
+		rnd := newRender(t, nil, LogRequestOnError(enable))
+		get(rnd("missing"), request)
+		out := logs.String()
+		if got := strings.Contains(out, `"path": "/account"`); got != enable {
+			t.Errorf("LogRequestOnError(%v) logs the request: %v, log is %q", enable, got, out)
+		}
+		if enable && (!strings.Contains(out, `"query": "tab=billing"`) || !strings.Contains(out, `"User-Agent": "tester"`) ||
+			!strings.Contains(out, `"Cookie": "[redacted]"`) || strings.Contains(out, "secret")) {
+			t.Errorf("request log is %q, want the query, the headers and the cookie redacted", out)
+		}
+	}
+}
+
+func TestReloadInterval(t *testing.T) {
+	root := writeTemplates(t, nil)
+	rnd, err := New(TemplatesPath(root), ReloadInterval(10*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rnd.Close()
+	handler := rnd("home", data(D{"hello": "world"}))
+	if body := get(handler).Body.String(); body != "<html>hello world</html>" {
+		t.Fatalf("body is %q", body)
+	}
+
+	// change writes the home view, with a later modification time than the last one.
+	modTime := time.Now()
+	change := func(content string) {
+		writeFiles(t, root, map[string]string{"home.html": content})
+		modTime = modTime.Add(time.Second)
+		if err := os.Chtimes(filepath.Join(root, "home.html"), modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	change(`{{ define "content" }}reloaded {{ .hello }}{{ end }}`)
+	deadline := time.Now().Add(2 * time.Second)
+	for get(handler).Body.String() != "<html>reloaded world</html>" {
+		if time.Now().After(deadline) {
+			t.Fatalf("the changed view isn't reloaded, body is %q", get(handler).Body.String())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	rnd.Close()
+	rnd.Close()
+	change(`{{ define "content" }}closed {{ .hello }}{{ end }}`)
+	time.Sleep(50 * time.Millisecond)
+	if body := get(handler).Body.String(); body != "<html>reloaded world</html>" {
+		t.Errorf("body after Close is %q, want the templates loaded last", body)
+	}
+	newRender(t, nil).Close()
+}
+
+func TestGlobals(t *testing.T) {
+	rnd := newRender(t, map[string]string{"about.html": `{{ define "content" }}{{ .app }} {{ .version }}{{ end }}`},
+		Globals(D{"app": "shop", "version": "1.0"}))
+	if body := get(rnd("about")).Body.String(); body != "<html>shop 1.0</html>" {
+		t.Errorf("body is %q", body)
+	}
+	if body := get(rnd("about", data(D{"version": "2.0-beta"}))).Body.String(); body != "<html>shop 2.0-beta</html>" {
+		t.Errorf("overridden body is %q", body)
+	}
+	if body := get(rnd("about")).Body.String(); body != "<html>shop 1.0</html>" {
+		t.Errorf("body after an override is %q, want the globals unchanged", body)
+	}
+}
+
+func TestRenderSandboxed(t *testing.T) {
+	rnd := newRender(t, nil)
+	out, err := rnd.RenderSandboxed(`{{ upper .name }} has {{ len .items }} items`, D{"name": "ann", "items": []int{1, 2}}, []string{"upper"})
+	if err != nil || out != "ANN has 2 items" {
+		t.Errorf("sandboxed output is %q, error %v", out, err)
+	}
+	if _, err := rnd.RenderSandboxed(`{{ env "HOME" }}`, nil, []string{"upper"}); err == nil || !strings.Contains(err.Error(), `function "env" not defined`) {
+		t.Errorf("calling a disallowed func error is %v, want a parse error", err)
+	}
+	if _, err := rnd.RenderSandboxed(`{{ template "main" }}`, nil, nil); err == nil {
+		t.Error("a sandboxed template includes a partial")
+	}
+	if _, err := rnd.RenderSandboxed(`x`, nil, []string{"unknown"}); err == nil {
+		t.Error("an unknown allowed func succeeds")
+	}
+}
+
+func TestContentTypeFor(t *testing.T) {
+	rnd := newRender(t, map[string]string{"robots.html": `{{ define "content" }}User-agent: *{{ end }}`})
+	if contentType := get(rnd("robots", ContentTypeFor("text/plain"))).Header().Get("Content-Type"); contentType != "text/plain" {
+		t.Errorf("content type is %q, want text/plain", contentType)
+	}
+	if contentType := get(rnd("robots")).Header().Get("Content-Type"); contentType != "text/html; charset=utf-8" {
+		t.Errorf("default content type is %q", contentType)
+	}
+}
+
+func TestTrimOutput(t *testing.T) {
+	files := map[string]string{"layouts/index.html": "\n\n  <html>{{ template \"content\" . }}</html>\n  \n"}
+	for _, tc := range []struct {
+		trim bool
+		want string
+	}{
+		{false, "\n\n  <html>hello world</html>\n  \n"},
+		{true, "<html>hello world</html>"},
+	} {
+		rnd := newRender(t, files, TrimOutput(tc.trim))
+		if body := get(rnd("home", data(D{"hello": "world"}))).Body.String(); body != tc.want {
+			t.Errorf("TrimOutput(%v) body is %q, want %q", tc.trim, body, tc.want)
+		}
+	}
+}
+
+func TestBuildInfo(t *testing.T) {
+	rnd := newRender(t, map[string]string{
+		"layouts/index.html": `<html>{{ template "content" . }}<footer>{{ ._build.commit }} {{ ._build.time }}</footer></html>`,
+	}, BuildInfo(D{"commit": "3f2a1bc", "time": "2026-10-14"}))
+	if body := get(rnd("home", data(D{"hello": "world"}))).Body.String(); body != "<html>hello world<footer>3f2a1bc 2026-10-14</footer></html>" {
+		t.Errorf("body is %q", body)
+	}
+}
+
+func TestHandlerE(t *testing.T) {
+	files := map[string]string{"broken.html": `{{ define "content" }}{{ .hello.missing }}{{ end }}`}
+	serve := func(handler func(http.ResponseWriter, *http.Request) error, modify ...func(*http.Request)) (*httptest.ResponseRecorder, error) {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		for _, fn := range modify {
+			fn(r)
+		}
+		w := httptest.NewRecorder()
+		return w, handler(w, r)
+	}
+
+	rnd := newRender(t, files)
+	w, err := serve(rnd.HandlerE("home", data(D{"hello": "world"})))
+	if err != nil || w.Body.String() != "<html>hello world</html>" {
+		t.Errorf("HandlerE of a view is %q, error %v", w.Body.String(), err)
+	}
+
+	captureLog(t)
+	cached := data(D{"hello": "world", "_cache": CacheControl{MaxAge: 60}})
+	invalid := func(w http.ResponseWriter, r *http.Request) (D, error) {
+		return D{"f": func() {}}, nil
+	}
+	full := newRender(t, files, MaxConcurrentRenders(1, true))
+	full.renderer().renderSlots <- struct{}{}
+	for _, tc := range []struct {
+		name    string
+		handler func(http.ResponseWriter, *http.Request) error
+		modify  []func(*http.Request)
+	}{
+		{"missing view", rnd.HandlerE("missing", cached), nil},
+		{"broken view", rnd.HandlerE("broken", cached), nil},
+		{"FailOnViewDataError", newRender(t, files, FailOnViewDataError(true)).HandlerE("home", userError("invalid")), nil},
+		{"FailOnDefaultDataError", newRender(t, files, FailOnDefaultDataError(true), DefaultData(userError("invalid"))).HandlerE("home"), nil},
+		{"RequireDefaultData", newRender(t, files, RequireDefaultData(true), DefaultData(data(nil))).HandlerE("home"), nil},
+		{"StrictKeys", newRender(t, files, StrictKeys(true)).HandlerE("home", data(D{"errors": "mine"})), nil},
+		{"RequireKeys", newRender(t, files, StrictKeys(true), RequireKeys("home", "hello")).HandlerE("home"), nil},
+		{"JSON", newRender(t, files, NegotiateJSON(true)).HandlerE("home", cached, invalid), []func(*http.Request){acceptJSON}},
+		{"MaxConcurrentRenders", full.HandlerE("home", cached), nil},
+	} {
+		w, err := serve(tc.handler, tc.modify...)
+		if err == nil {
+			t.Errorf("%s: HandlerE returns no error", tc.name)
+		}
+		header := w.Header()
+		if w.Body.Len() != 0 || header.Get("Content-Type") != "" || header.Get("Cache-Control") != "" {
+			t.Errorf("%s: HandlerE wrote %q with the headers %v", tc.name, w.Body.String(), header)
+		}
+	}
+}
+
+func TestAllowedViews(t *testing.T) {
+	logs := captureLog(t)
+	rnd := newRender(t, map[string]string{"about.html": `{{ define "content" }}about{{ end }}`}, AllowedViews([]string{"about"}))
+	if w := get(rnd("about")); w.Code != http.StatusOK || w.Body.String() != "<html>about</html>" {
+		t.Errorf("allowed view response is %d %q", w.Code, w.Body.String())
+	}
+	for _, view := range []string{"home", "../partials/main"} {
+		if w := get(rnd(view)); w.Code != http.StatusNotFound {
+			t.Errorf("view %s response is %d %q, want a 404", view, w.Code, w.Body.String())
+		}
+	}
+	if !strings.Contains(logs.String(), "renderlayout:render view [home] => not found, it isn't an allowed view") {
+		t.Errorf("log is %q", logs.String())
+	}
+}
+
+func TestStatusData(t *testing.T) {
+	rnd := newRender(t, map[string]string{"error.html": `{{ define "content" }}{{ ._status }} {{ ._status_text }}{{ end }}`})
+	for _, tc := range []struct {
+		status   int
+		dataFunc Data
+		want     string
+	}{
+		{http.StatusNotFound, data(nil), "<html>404 Not Found</html>"},
+		{http.StatusInternalServerError, data(nil), "<html>500 Internal Server Error</html>"},
+		{http.StatusNotFound, data(D{"_status_text": "No such page"}), "<html>404 No such page</html>"},
+		{http.StatusOK, data(nil), "<html> </html>"},
+	} {
+		w := get(rnd.Respond(tc.status, nil, "error", tc.dataFunc))
+		if w.Code != tc.status || w.Body.String() != tc.want {
+			t.Errorf("status %d response is %d %q, want %q", tc.status, w.Code, w.Body.String(), tc.want)
+		}
+	}
+}
+
+func TestWithFuncs(t *testing.T) {
+	files := map[string]string{"report.html": `{{ define "content" }}{{ quarter .month }}{{ end }}`}
+	rnd := newRender(t, files)
+	quarter := WithFuncs(template.FuncMap{"quarter": func(month int) string { return fmt.Sprintf("Q%d", (month+2)/3) }})
+	if body := get(rnd("report", quarter, data(D{"month": 5}))).Body.String(); body != "<html>Q2</html>" {
+		t.Errorf("body with the func is %q", body)
+	}
+	captureLog(t)
+	if body := get(rnd("report", data(D{"month": 5}))).Body.String(); !strings.HasSuffix(body, "Something went wrong.") {
+		t.Errorf("body without the func is %q, want the render error", body)
+	}
+	fiscal := WithFuncs(template.FuncMap{"quarter": func(month int) string { return "FY" }})
+	if body := get(rnd("report", quarter, fiscal, data(D{"month": 5}))).Body.String(); body != "<html>FY</html>" {
+		t.Errorf("body with merged funcs is %q", body)
+	}
+	if body := get(rnd("report", quarter, data(D{"month": 11}))).Body.String(); body != "<html>Q4</html>" {
+		t.Errorf("body after another render is %q", body)
+	}
+}
+
+// closingReader is a strings.Reader recording whether it's closed.
+type closingReader struct {
+	*strings.Reader
+	closed bool
+}
+
+func (r *closingReader) Close() error {
+	r.closed = true
+	return nil
+}
+
+func TestDownload(t *testing.T) {
+	rnd := newRender(t, nil)
+	body := &closingReader{Reader: strings.NewReader("id,name\n1,ann\n")}
+	export := func(w http.ResponseWriter, r *http.Request) (D, error) {
+		return nil, Download("users 2026.csv", "text/csv", body)
+	}
+	w := get(rnd("home", export))
+	if w.Code != http.StatusOK || w.Body.String() != "id,name\n1,ann\n" {
+		t.Errorf("response is %d %q", w.Code, w.Body.String())
+	}
+	if disposition := w.Header().Get("Content-Disposition"); disposition != `attachment; filename="users 2026.csv"` {
+		t.Errorf("Content-Disposition is %q", disposition)
+	}
+	if contentType := w.Header().Get("Content-Type"); contentType != "text/csv" {
+		t.Errorf("content type is %q", contentType)
+	}
+	if !body.closed {
+		t.Error("the body isn't closed")
+	}
+}
+
+// flashStore is a FlashStore keeping the flash messages in memory.
+type flashStore struct {
+	msgs []string
+}
+
+func (s *flashStore) SetFlash(w http.ResponseWriter, r *http.Request, msg string) error {
+	s.msgs = append(s.msgs, msg)
+	return nil
+}
+
+func TestSaveFlashes(t *testing.T) {
+	files := map[string]string{"saved.html": `{{ define "content" }}saved{{ ._flash }}{{ end }}`}
+	store := &flashStore{}
+	rnd := newRender(t, files, SaveFlashes(store), DefaultData(data(D{"_flash": "Welcome"})))
+	body := get(rnd("saved", data(D{"_flash": "Saved"}), LayoutData(data(D{"_flash": []string{"Emailed"}})))).Body.String()
+	if body != "<html>saved</html>" {
+		t.Errorf("body is %q", body)
+	}
+	if want := []string{"Welcome", "Saved", "Emailed"}; !reflect.DeepEqual(store.msgs, want) {
+		t.Errorf("flash messages are %q, want %q", store.msgs, want)
+	}
+
+	logs := captureLog(t)
+	rnd = newRender(t, files)
+	if body := get(rnd("saved", data(D{"_flash": "Saved"}))).Body.String(); body != "<html>saved</html>" {
+		t.Errorf("body without a store is %q", body)
+	}
+	if !strings.Contains(logs.String(), `the flash messages ["Saved"] are dropped without a FlashStore`) {
+		t.Errorf("log is %q, want the dropped flash warning", logs.String())
+	}
+}
+
+func TestBindQuery(t *testing.T) {
+	files := map[string]string{
+		"filter.html": `{{ define "content" }}{{ .query.Get "sort" }} {{ index .query "tag" }}{{ end }}`,
+		"bound.html":  `{{ define "content" }}{{ if .query }}bound{{ else }}unbound{{ end }}{{ end }}`,
+	}
+	withQuery := func(r *http.Request) {
+		r.URL.RawQuery = "sort=name&tag=go&tag=web"
+	}
+	rnd := newRender(t, files, BindQuery(true))
+	if body := get(rnd("filter"), withQuery).Body.String(); body != "<html>name [go web]</html>" {
+		t.Errorf("body is %q", body)
+	}
+	overwrite := data(D{"query": url.Values{"sort": {"date"}}})
+	if body := get(rnd("filter", overwrite), withQuery).Body.String(); body != "<html>date []</html>" {
+		t.Errorf("body with the query overwritten is %q", body)
+	}
+	rnd = newRender(t, files)
+	if body := get(rnd("bound"), withQuery).Body.String(); body != "<html>unbound</html>" {
+		t.Errorf("body without BindQuery is %q", body)
+	}
+}
+
+func TestErrorsNewestFirst(t *testing.T) {
+	files := map[string]string{"errors.html": `{{ define "content" }}{{ range .errors }}{{ . }};{{ end }}{{ end }}`}
+	for _, tc := range []struct {
+		newestFirst bool
+		want        string
+	}{
+		{false, "<html>First;Second;Third;</html>"},
+		{true, "<html>Third;Second;First;</html>"},
+	} {
+		rnd := newRender(t, files, ErrorsNewestFirst(tc.newestFirst), DefaultData(userError("first")))
+		if body := get(rnd("errors", userError("second"), userError("third"))).Body.String(); body != tc.want {
+			t.Errorf("ErrorsNewestFirst(%v) body is %q, want %q", tc.newestFirst, body, tc.want)
+		}
+	}
+}
+
+func TestValidationStatus(t *testing.T) {
+	files := map[string]string{"signup.html": `{{ define "content" }}{{ range .errors }}{{ . }};{{ end }}{{ end }}`}
+	rnd := newRender(t, files, ValidationStatus(http.StatusUnprocessableEntity))
+	w := get(rnd("signup", userError("email is taken"), userError("name is required")))
+	if w.Code != http.StatusUnprocessableEntity || w.Body.String() != "<html>Email is taken;Name is required;</html>" {
+		t.Errorf("response with errors is %d %q", w.Code, w.Body.String())
+	}
+	if w := get(rnd("signup", data(nil))); w.Code != http.StatusOK {
+		t.Errorf("status without errors is %d", w.Code)
+	}
+	if w := get(rnd.Respond(http.StatusConflict, nil, "signup", userError("email is taken"))); w.Code != http.StatusConflict {
+		t.Errorf("status of Respond is %d", w.Code)
+	}
+	if w := get(newRender(t, files)("signup", userError("email is taken"))); w.Code != http.StatusOK {
+		t.Errorf("status without ValidationStatus is %d", w.Code)
+	}
+	if w := get(newRender(t, files, ValidationStatus(0))("signup", userError("email is taken"))); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("status of the default ValidationStatus is %d", w.Code)
+	}
+	if w := get(newRender(t, files, ValidationStatus(http.StatusBadRequest))("signup", userError("email is taken"))); w.Code != http.StatusBadRequest {
+		t.Errorf("status of ValidationStatus(400) is %d", w.Code)
+	}
+}
+
+func TestURLBuilder(t *testing.T) {
+	files := map[string]string{"users.html": `{{ define "content" }}<a href="{{ url "user.show" .id }}">{{ .name }}</a>{{ end }}`}
+	routes := map[string]string{"user.show": "/users/%s"}
+	builder := func(name string, params ...string) string {
+		args := make([]interface{}, len(params))
+		for i, param := range params {
+			args[i] = param
+		}
+		return fmt.Sprintf(routes[name], args...)
+	}
+	rnd := newRender(t, files, URLBuilder(builder))
+	if body := get(rnd("users", data(D{"id": 42, "name": "ann"}))).Body.String(); body != `<html><a href="/users/42">ann</a></html>` {
+		t.Errorf("body is %q", body)
+	}
+}
+
+func TestAutoLang(t *testing.T) {
+	files := map[string]string{"layouts/index.html": `<html lang="{{ ._lang }}">{{ template "content" . }}</html>`}
+	lang := func(r *http.Request) string {
+		return r.URL.Query().Get("lang")
+	}
+	rnd := newRender(t, files, AutoLang(lang))
+	for _, tc := range []struct {
+		query string
+		want  string
+	}{
+		{"lang=en", `<html lang="en">hello world</html>`},
+		{"lang=de", `<html lang="de">hello world</html>`},
+		{"", `<html lang="">hello world</html>`},
+	} {
+		withLang := func(r *http.Request) {
+			r.URL.RawQuery = tc.query
+		}
+		if body := get(rnd("home", data(D{"hello": "world"})), withLang).Body.String(); body != tc.want {
+			t.Errorf("body of %q is %q, want %q", tc.query, body, tc.want)
+		}
+	}
+}
+
+func TestDirect(t *testing.T) {
+	files := map[string]string{"report.html": `{{ define "content" }}{{ .title }}: {{ .rows }} by {{ .author }}{{ end }}`}
+	rnd := newRender(t, files, DefaultData(data(D{"title": "Report", "author": "ann"})))
+	direct := D{"title": "Sales", "rows": []int{1, 2}}
+	if body := get(rnd.Direct("report", direct)).Body.String(); body != "<html>Sales: [1 2] by ann</html>" {
+		t.Errorf("body is %q", body)
+	}
+	if want := (D{"title": "Sales", "rows": []int{1, 2}}); !reflect.DeepEqual(direct, want) {
+		t.Errorf("data is modified to %v", direct)
+	}
+}
+
+// syncBuffer is a bytes.Buffer safe for the log writes of the renders still running past their timeout.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestRenderTimeout(t *testing.T) {
+	logs := new(syncBuffer)
+	log.SetOutput(logs)
+	t.Cleanup(func() {
+		log.SetOutput(os.Stderr)
+	})
+	files := map[string]string{"broken.html": `{{ define "content" }}{{ .hello.missing }}{{ end }}`}
+	rnd := newRender(t, files, RenderTimeout(20*time.Millisecond))
+	slow := func(w http.ResponseWriter, r *http.Request) (D, error) {
+		select {
+		case <-time.After(time.Second):
+		case <-r.Context().Done():
+		}
+		return D{"hello": "late"}, nil
+	}
+	w := get(rnd("home", slow))
+	if w.Code != http.StatusServiceUnavailable || w.Body.String() != "Something went wrong." {
+		t.Errorf("response of a slow render is %d %q", w.Code, w.Body.String())
+	}
+	if !strings.Contains(logs.String(), "render view [home] => timed out after 20ms") {
+		t.Errorf("log is %q, want the timeout", logs.String())
+	}
+	if w := get(rnd("home", data(D{"hello": "world"}))); w.Code != http.StatusOK || w.Body.String() != "<html>hello world</html>" {
+		t.Errorf("response of a fast render is %d %q", w.Code, w.Body.String())
+	}
+
+	for _, tc := range []struct {
+		name     string
+		view     string
+		dataFunc Data
+	}{
+		{"slow", "home", slow},
+		{"broken", "broken", data(D{"hello": "world", "_cache": CacheControl{MaxAge: 60}})},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		w := httptest.NewRecorder()
+		if err := rnd.HandlerE(tc.view, tc.dataFunc)(w, r); err == nil {
+			t.Errorf("%s: HandlerE returns no error", tc.name)
+		}
+		// the error handler writes its own response.
+		w.WriteHeader(http.StatusInternalServerError)
+		if w.Code != http.StatusInternalServerError {
+			t.Errorf("%s: HandlerE wrote the status %d", tc.name, w.Code)
+		}
+		if w.Body.Len() != 0 || w.Header().Get("Cache-Control") != "" || w.Header().Get("Content-Type") != "" {
+			t.Errorf("%s: HandlerE wrote %q with the headers %v", tc.name, w.Body.String(), w.Header())
+		}
+	}
+}
+
+func TestSurrogateKeys(t *testing.T) {
+	files := map[string]string{
+		"product.html": `{{ define "content" }}{{ .name }}{{ ._surrogate_keys }}{{ end }}`,
+		"broken.html":  `{{ define "content" }}{{ .name.missing }}{{ end }}`,
+	}
+	rnd := newRender(t, files, DefaultData(data(D{"_surrogate_keys": []string{"layout"}})))
+	product := data(D{"name": "lamp", "_surrogate_keys": []string{"product-42", "category-7"}})
+	reviews := data(D{"_surrogate_keys": []string{"reviews-42", "product-42"}})
+	w := get(rnd("product", product, reviews))
+	if keys := w.Header().Get("Surrogate-Key"); keys != "layout product-42 category-7 reviews-42" {
+		t.Errorf("Surrogate-Key is %q", keys)
+	}
+	if body := w.Body.String(); body != "<html>lamp</html>" {
+		t.Errorf("body is %q", body)
+	}
+	if keys := get(rnd("home")).Header().Get("Surrogate-Key"); keys != "layout" {
+		t.Errorf("Surrogate-Key of the default data is %q", keys)
+	}
+
+	captureLog(t)
+	w = get(rnd("broken", product))
+	if w.Code != http.StatusInternalServerError || w.Header().Get("Surrogate-Key") != "" {
+		t.Errorf("failed render is %d with the Surrogate-Key %q", w.Code, w.Header().Get("Surrogate-Key"))
+	}
+}
+
+func TestFragmentWhen(t *testing.T) {
+	embed := func(r *http.Request) bool {
+		return r.URL.Query().Get("embed") == "1"
+	}
+	rnd := newRender(t, nil, FragmentWhen(embed))
+	for _, tc := range []struct {
+		query string
+		want  string
+	}{
+		{"embed=1", "hello world"},
+		{"embed=0", "<html>hello world</html>"},
+		{"", "<html>hello world</html>"},
+	} {
+		withQuery := func(r *http.Request) {
+			r.URL.RawQuery = tc.query
+		}
+		if body := get(rnd("home", data(D{"hello": "world"})), withQuery).Body.String(); body != tc.want {
+			t.Errorf("body of %q is %q, want %q", tc.query, body, tc.want)
+		}
+	}
+}
+
+func TestDependencies(t *testing.T) {
+	rnd := newRender(t, map[string]string{
+		"partials/header.html": `{{ define "header" }}header{{ end }}`,
+		"profile.html":         `{{ define "content" }}{{ template "header" }}{{ end }}`,
+		"dashboard.html":       `{{ define "content" }}{{ if .admin }}{{ include "widgets/card" | printf "%s" }}{{ end }}{{ end }}`,
+		"widgets/card.html":    `card {{ template "main" }}`,
+	})
+	for _, tc := range []struct {
+		view string
+		want []string
+	}{
+		{"home", []string{"layouts/index"}},
+		{"profile", []string{"layouts/index", "partials/header"}},
+		{"dashboard", []string{"layouts/index", "partials/main", "widgets/card"}},
+	} {
+		if deps := rnd.Dependencies(tc.view); !reflect.DeepEqual(deps, tc.want) {
+			t.Errorf("dependencies of %s are %q, want %q", tc.view, deps, tc.want)
+		}
+	}
+	captureLog(t)
+	if deps := rnd.Dependencies("missing"); deps != nil {
+		t.Errorf("dependencies of a missing view are %q", deps)
+	}
+}
+
+func TestCSRF(t *testing.T) {
+	files := map[string]string{"form.html": `{{ define "content" }}<form>{{ csrfField }}</form>{{ csrfToken }}{{ end }}`}
+	token := func(r *http.Request) string {
+		return r.Header.Get("X-Test-Token")
+	}
+	rnd := newRender(t, files, CSRF("gorilla.csrf.Token", token))
+	for _, tc := range []struct {
+		token string
+		want  string
+	}{
+		{"abc123", `<html><form><input type="hidden" name="gorilla.csrf.Token" value="abc123"></form>abc123</html>`},
+		{`x"y`, `<html><form><input type="hidden" name="gorilla.csrf.Token" value="x&#34;y"></form>x&#34;y</html>`},
+	} {
+		withToken := func(r *http.Request) {
+			r.Header.Set("X-Test-Token", tc.token)
+		}
+		if body := get(rnd("form"), withToken).Body.String(); body != tc.want {
+			t.Errorf("body of the token %q is %q, want %q", tc.token, body, tc.want)
+		}
+	}
+}
+
+func TestValidatePartialRefs(t *testing.T) {
+	broken := map[string]string{"broken.html": `{{ define "content" }}{{ template "partials/missing" }}{{ end }}`}
+	root := writeTemplates(t, broken)
+	_, err := New(TemplatesPath(root), ValidatePartialRefs(true))
+	if err == nil || !strings.Contains(err.Error(), `validate view [broken] => undefined templates ["partials/missing"]`) {
+		t.Errorf("New error is %v, want the undefined partial", err)
+	}
+	if _, err := New(TemplatesPath(root)); err != nil {
+		t.Errorf("New without ValidatePartialRefs fails, %v", err)
+	}
+
+	// the files outside of the views path aren't views.
+	root = writeTemplates(t, map[string]string{
+		"emails/broken.html": broken["broken.html"],
+		"pages/about.html":   `{{ define "content" }}about {{ template "main" }}{{ end }}`,
+	})
+	if _, err := New(TemplatesPath(root), ViewsPath("pages"), ValidatePartialRefs(true)); err != nil {
+		t.Errorf("New with the views path fails, %v", err)
+	}
+	writeFiles(t, root, map[string]string{"pages/broken.html": broken["broken.html"]})
+	_, err = New(TemplatesPath(root), ViewsPath("pages"), ValidatePartialRefs(true))
+	if err == nil || !strings.Contains(err.Error(), "validate view [pages/broken]") {
+		t.Errorf("New error with the views path is %v, want the undefined partial", err)
+	}
+}
+
+func TestDataPanic(t *testing.T) {
+	logs := captureLog(t)
+	files := map[string]string{"dashboard.html": `{{ define "content" }}{{ .orders }}{{ range .errors }};{{ . }}{{ end }}{{ end }}`}
+	orders := data(D{"orders": 3})
+	broken := func(w http.ResponseWriter, r *http.Request) (D, error) {
+		var stats map[string]int
+		stats["visits"]++
+		return D{"visits": stats["visits"]}, nil
+	}
+	for _, tc := range []struct {
+		name string
+		rnd  Render
+	}{
+		{"default", newRender(t, files)},
+		{"ValidationStatus", newRender(t, files, ValidationStatus(http.StatusUnprocessableEntity))},
+	} {
+		w := get(tc.rnd("dashboard", orders, broken))
+		if w.Code != http.StatusOK || w.Body.String() != "<html>3;Something went wrong.</html>" {
+			t.Errorf("%s: response is %d %q", tc.name, w.Code, w.Body.String())
+		}
+	}
+	if !strings.Contains(logs.String(), "renderlayout:data => panic: assignment to entry in nil map") ||
+		!strings.Contains(logs.String(), "debug.Stack") {
+		t.Errorf("log is %q, want the panic with the stack", logs.String())
+	}
+
+	// a user error with the panic still responds with the ValidationStatus.
+	rnd := newRender(t, files, ValidationStatus(http.StatusUnprocessableEntity))
+	if w := get(rnd("dashboard", orders, broken, userError("no orders"))); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("status with a user error is %d", w.Code)
+	}
+}
+
+func TestBrotli(t *testing.T) {
+	rnd := newRender(t, nil, Brotli(true))
+	for _, tc := range []struct {
+		acceptEncoding string
+		compressed     bool
+	}{
+		{"gzip, deflate, br", true},
+		{"br;q=1.0", true},
+		{"gzip", false},
+		{"br;q=0", false},
+		{"", false},
+	} {
+		withEncoding := func(r *http.Request) {
+			r.Header.Set("Accept-Encoding", tc.acceptEncoding)
+		}
+		w := get(rnd("home", data(D{"hello": "world"})), withEncoding)
+		if vary := w.Header().Get("Vary"); vary != "Accept-Encoding" {
+			t.Errorf("%q: Vary is %q", tc.acceptEncoding, vary)
+		}
+		body := w.Body.Bytes()
+		if tc.compressed {
+			if encoding := w.Header().Get("Content-Encoding"); encoding != "br" {
+				t.Errorf("%q: Content-Encoding is %q", tc.acceptEncoding, encoding)
+			}
+			var err error
+			if body, err = ioutil.ReadAll(brotli.NewReader(bytes.NewReader(body))); err != nil {
+				t.Errorf("%q: body doesn't decompress, %v", tc.acceptEncoding, err)
+			}
+		} else if encoding := w.Header().Get("Content-Encoding"); encoding != "" {
+			t.Errorf("%q: Content-Encoding is %q", tc.acceptEncoding, encoding)
+		}
+		if string(body) != "<html>hello world</html>" {
+			t.Errorf("%q: body is %q", tc.acceptEncoding, body)
+		}
+	}
+}
+
+func TestCriticalCSS(t *testing.T) {
+	files := map[string]string{"layouts/index.html": `<html><style>{{ criticalCSS }}</style>{{ template "content" . }}</html>`}
+	css := filepath.Join(t.TempDir(), "critical.css")
+	writeFiles(t, filepath.Dir(css), map[string]string{"critical.css": `body > main { font: 1em "Inter" }`})
+	want := `<html><style>body > main { font: 1em "Inter" }</style>hello world</html>`
+
+	rnd := newRender(t, files, CriticalCSS(css))
+	reloading := newRender(t, files, CriticalCSS(css), DisableCache(true))
+	for name, rnd := range map[string]Render{"cached": rnd, "DisableCache": reloading} {
+		if body := get(rnd("home", data(D{"hello": "world"}))).Body.String(); body != want {
+			t.Errorf("%s: body is %q, want %q", name, body, want)
+		}
+	}
+
+	writeFiles(t, filepath.Dir(css), map[string]string{"critical.css": "main { color: red }"})
+	if body := get(rnd("home", data(D{"hello": "world"}))).Body.String(); body != want {
+		t.Errorf("cached body after a change is %q", body)
+	}
+	if body := get(reloading("home", data(D{"hello": "world"}))).Body.String(); body != "<html><style>main { color: red }</style>hello world</html>" {
+		t.Errorf("reloaded body after a change is %q", body)
+	}
+
+	if _, err := New(TemplatesPath(writeTemplates(t, files)), CriticalCSS(filepath.Join(t.TempDir(), "missing.css"))); err == nil {
+		t.Error("New with a missing critical css file didn't fail")
+	}
+}
+
+func TestBlock(t *testing.T) {
+	rnd := newRender(t, map[string]string{
+		"users.html": `{{ define "content" }}<table>{{ range .users }}{{ template "row" . }}{{ end }}</table>{{ end }}` +
+			`{{ define "row" }}<tr><td>{{ .name }}</td></tr>{{ end }}`,
+	})
+	b, err := rnd.Block("users", "row", D{"name": "<ann>"})
+	if err != nil || string(b) != "<tr><td>&lt;ann&gt;</td></tr>" {
+		t.Errorf("row block is %q, %v", b, err)
+	}
+	b, err = rnd.Block("users", "main", nil)
+	if err != nil || string(b) != "main" {
+		t.Errorf("partial block is %q, %v", b, err)
+	}
+	if _, err := rnd.Block("users", "missing", nil); err == nil {
+		t.Error("a missing block didn't fail")
+	}
+	if _, err := rnd.Block("missing", "row", nil); err == nil {
+		t.Error("the block of a missing view didn't fail")
+	}
+}
+
+func TestRequireDefaultData(t *testing.T) {
+	logs := captureLog(t)
+	for _, tc := range []struct {
+		name        string
+		require     bool
+		defaultData Data
+		status      int
+		want        string
+	}{
+		{"nil", true, data(nil), http.StatusInternalServerError, "Something went wrong."},
+		{"empty", true, data(D{}), http.StatusOK, "<html>hello world</html>"},
+		{"error", true, userError("offline"), http.StatusOK, "<html>hello world</html>"},
+		{"nil without the option", false, data(nil), http.StatusOK, "<html>hello world</html>"},
+	} {
+		rnd := newRender(t, nil, RequireDefaultData(tc.require), DefaultData(tc.defaultData))
+		w := get(rnd("home", data(D{"hello": "world"})))
+		if w.Code != tc.status || w.Body.String() != tc.want {
+			t.Errorf("%s: response is %d %q, want %d %q", tc.name, w.Code, w.Body.String(), tc.status, tc.want)
+		}
+	}
+	if !strings.Contains(logs.String(), "renderlayout:defaultData => returned no data") {
+		t.Errorf("log is %q, want the missing default data", logs.String())
+	}
+}
+
+func TestLayoutDataFor(t *testing.T) {
+	rnd := newRender(t, map[string]string{
+		"layouts/index.html": `<title>{{ .layout.title }}</title>{{ template "content" . }}`,
+		"settings.html":      `{{ define "content" }}settings{{ .title }}{{ end }}`,
+	}, LayoutDataFor(map[string]Data{"settings": data(D{"title": "Settings"})}))
+	if body := get(rnd("settings")).Body.String(); body != "<title>Settings</title>settings" {
+		t.Errorf("body is %q", body)
+	}
+	override := LayoutData(data(D{"title": "Your settings"}))
+	if body := get(rnd("settings", override)).Body.String(); body != "<title>Your settings</title>settings" {
+		t.Errorf("body with the layout data of the handler is %q", body)
+	}
+	if body := get(rnd("home", data(D{"hello": "world"}))).Body.String(); body != "<title></title>hello world" {
+		t.Errorf("body of another view is %q", body)
+	}
+}
+
+func TestReplaceFuncs(t *testing.T) {
+	logs := captureLog(t)
+	rnd := newRender(t, map[string]string{
+		"shout.html":   `{{ define "content" }}{{ shout .hello }}{{ end }}`,
+		"sprig.html":   `{{ define "content" }}{{ upper .hello }}{{ end }}`,
+		"ignored.html": `{{ define "content" }}{{ added }}{{ end }}`,
+	}, ReplaceFuncs(template.FuncMap{"shout": strings.ToUpper}), AddFuncs(template.FuncMap{"added": func() string { return "added" }}))
+	if body := get(rnd("shout", data(D{"hello": "world"}))).Body.String(); body != "<html>WORLD</html>" {
+		t.Errorf("body with the custom func is %q", body)
+	}
+	for _, view := range []string{"sprig", "ignored"} {
+		if body := get(rnd(view, data(D{"hello": "world"}))).Body.String(); body != "Something went wrong." {
+			t.Errorf("body of %s is %q, want the render error", view, body)
+		}
+	}
+	if !strings.Contains(logs.String(), `function "upper" not defined`) {
+		t.Errorf("log is %q, want the undefined sprig func", logs.String())
+	}
+}
+
+func TestEnvironment(t *testing.T) {
+	captureLog(t)
+	internal := func(w http.ResponseWriter, r *http.Request) (D, error) {
+		return nil, errors.New("db: connection refused")
+	}
+	for _, tc := range []struct {
+		env     string
+		details bool
+	}{
+		{"", false},
+		{"production", false},
+		{"development", true},
+	} {
+		rnd := newRender(t, nil, Environment(tc.env), FailOnViewDataError(true))
+		w := get(rnd("home", data(D{"hello": "<world>"}), internal))
+		body := w.Body.String()
+		if w.Code != http.StatusInternalServerError || !strings.HasPrefix(body, "Something went wrong.") {
+			t.Errorf("%q: response is %d %q", tc.env, w.Code, body)
+		}
+		if details := strings.Contains(body, "db: connection refused"); details != tc.details {
+			t.Errorf("%q: body %q shows the internal error: %v, want %v", tc.env, body, details, tc.details)
+		}
+		if tc.details && (!strings.Contains(body, "&#34;hello&#34;") || strings.Contains(body, "<world>")) {
+			t.Errorf("%q: body %q doesn't show the escaped view data", tc.env, body)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+// Package session provides view data from gorilla/sessions for renderlayout.
+// It's a separate package so only the apps using it depend on gorilla/sessions.
+package session
+
+import (
+	"fmt"
+	"net/http"
+
+	rl "github.com/adnaan/renderlayout"
+	"github.com/gorilla/sessions"
+)
+
+// Data returns view data mapped from the named session in the store. If mapper is nil, the session values with string keys
+// are the view data. Errors reading the session are logged, and not shown to the user.
+func Data(store sessions.Store, name string, mapper func(*sessions.Session) rl.D) rl.Data {
+	if mapper == nil {
+		mapper = values
+	}
+	return func(w http.ResponseWriter, r *http.Request) (rl.D, error) {
+		s, err := store.Get(r, name)
+		if err != nil {
+			// a new session is returned along with the error
+			err = fmt.Errorf("session:get %s => %v", name, err)
+		}
+		if s == nil {
+			return nil, err
+		}
+		return mapper(s), err
+	}
+}
+
+// flashesKey is the view data key of the flash messages.
+const flashesKey = "flashes"
+
+// FlashStore returns the rl.FlashStore adding the flash messages to the named session in the store, for rl.SaveFlashes,
+// so the next request reads them with Flashes.
+func FlashStore(store sessions.Store, name string) rl.FlashStore {
+	return flashStore{store: store, name: name}
+}
+
+type flashStore struct {
+	store sessions.Store
+	name  string
+}
+
+// SetFlash adds the flash message to the session and saves it.
+func (f flashStore) SetFlash(w http.ResponseWriter, r *http.Request, msg string) error {
+	s, err := f.store.Get(r, f.name)
+	if s == nil {
+		return fmt.Errorf("session:get %s => %v", f.name, err)
+	}
+	s.AddFlash(msg)
+	if err := s.Save(r, w); err != nil {
+		return fmt.Errorf("session:save %s => %v", f.name, err)
+	}
+	return nil
+}
+
+// Flashes returns the Data func reading the flash messages of the named session in the store under the "flashes" key,
+// e.g. {{ range .flashes }}. The messages are cleared, so they're shown once.
+func Flashes(store sessions.Store, name string) rl.Data {
+	return func(w http.ResponseWriter, r *http.Request) (rl.D, error) {
+		s, err := store.Get(r, name)
+		if s == nil {
+			return nil, fmt.Errorf("session:get %s => %v", name, err)
+		}
+		flashes := s.Flashes()
+		if len(flashes) == 0 {
+			return nil, nil
+		}
+		if err := s.Save(r, w); err != nil {
+			return nil, fmt.Errorf("session:save %s => %v", name, err)
+		}
+		msgs := make([]string, 0, len(flashes))
+		for _, flash := range flashes {
+			msgs = append(msgs, fmt.Sprint(flash))
+		}
+		return rl.D{flashesKey: msgs}, nil
+	}
+}
+
+func values(s *sessions.Session) rl.D {
+	d := make(rl.D)
+	for k, v := range s.Values {
+		if key, ok := k.(string); ok {
+			d[key] = v
+		}
+	}
+	return d
+}
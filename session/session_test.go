@@ -0,0 +1,120 @@
+package session
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	rl "github.com/adnaan/renderlayout"
+	"github.com/gorilla/sessions"
+)
+
+// memoryStore is a sessions.Store keeping the values of the sessions in memory, by the session name.
+type memoryStore struct {
+	values map[string]map[interface{}]interface{}
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{values: make(map[string]map[interface{}]interface{})}
+}
+
+func (s *memoryStore) Get(r *http.Request, name string) (*sessions.Session, error) {
+	return s.New(r, name)
+}
+
+func (s *memoryStore) New(r *http.Request, name string) (*sessions.Session, error) {
+	session := sessions.NewSession(s, name)
+	values, ok := s.values[name]
+	session.IsNew = !ok
+	for k, v := range values {
+		session.Values[k] = v
+	}
+	return session, nil
+}
+
+func (s *memoryStore) Save(r *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+	values := make(map[interface{}]interface{}, len(session.Values))
+	for k, v := range session.Values {
+		values[k] = v
+	}
+	s.values[session.Name()] = values
+	return nil
+}
+
+// newRender returns the Render of the view home.html with the layout and the options.
+func newRender(t *testing.T, home string, opts ...rl.Option) rl.Render {
+	t.Helper()
+	root := t.TempDir()
+	for name, content := range map[string]string{
+		"layouts/index.html": `<html>{{ template "content" . }}</html>`,
+		"partials/main.html": `{{ define "main" }}main{{ end }}`,
+		"home.html":          home,
+	} {
+		file := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rnd, err := rl.New(append([]rl.Option{rl.TemplatesPath(root)}, opts...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rnd
+}
+
+// get returns the response of the handler to a GET request.
+func get(handler http.HandlerFunc) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	return w
+}
+
+func TestData(t *testing.T) {
+	store := newMemoryStore()
+	store.values["app"] = map[interface{}]interface{}{"user": "ada", 42: "not a string key"}
+	rnd := newRender(t, `{{ define "content" }}{{ .user }} {{ .role }}{{ end }}`)
+
+	if body := get(rnd("home", Data(store, "app", nil))).Body.String(); body != "<html>ada </html>" {
+		t.Errorf("body is %q", body)
+	}
+	mapper := func(s *sessions.Session) rl.D {
+		return rl.D{"user": s.Values["user"], "role": "admin"}
+	}
+	if body := get(rnd("home", Data(store, "app", mapper))).Body.String(); body != "<html>ada admin</html>" {
+		t.Errorf("mapped body is %q", body)
+	}
+}
+
+func TestFlashes(t *testing.T) {
+	store := newMemoryStore()
+	rnd := newRender(t, `{{ define "content" }}{{ range .flashes }}[{{ . }}]{{ end }}{{ ._flash }}{{ end }}`,
+		rl.SaveFlashes(FlashStore(store, "app")))
+	save := func(w http.ResponseWriter, r *http.Request) (rl.D, error) {
+		return rl.D{"_flash": []string{"Saved", "Emailed"}}, nil
+	}
+	if body := get(rnd("home", save)).Body.String(); body != "<html></html>" {
+		t.Errorf("body of the request setting the flash is %q", body)
+	}
+	if body := get(rnd("home", Flashes(store, "app"))).Body.String(); body != "<html>[Saved][Emailed]</html>" {
+		t.Errorf("body of the next request is %q", body)
+	}
+	if body := get(rnd("home", Flashes(store, "app"))).Body.String(); body != "<html></html>" {
+		t.Errorf("body of the request after is %q, want the flashes cleared", body)
+	}
+
+	moved := func(w http.ResponseWriter, r *http.Request) (rl.D, error) {
+		return rl.D{"_flash": "Moved"}, rl.NoContent()
+	}
+	if w := get(rnd("home", moved)); w.Code != http.StatusNoContent {
+		t.Errorf("response is %d, want a 204", w.Code)
+	}
+	if body := get(rnd("home", Flashes(store, "app"))).Body.String(); body != "<html>[Moved]</html>" {
+		t.Errorf("body after a responder is %q", body)
+	}
+}
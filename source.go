@@ -0,0 +1,67 @@
+package renderlayout
+
+import (
+	"bytes"
+	"regexp"
+	"strings"
+
+	"github.com/foolin/goview"
+)
+
+// preBlock matches a <pre> element, its whitespace is preserved.
+var preBlock = regexp.MustCompile(`(?is)<pre[\s>].*?</pre>`)
+
+// trimWhitespace removes the whitespace spanning lines between html tags and template actions, outside of <pre>
+// elements. e.g. "</li>\n    {{end}}" is "</li>{{end}}". Whitespace within a line is kept.
+func trimWhitespace(src string, delims goview.Delims) string {
+	left, right := delims.Left, delims.Right
+	if left == "" {
+		left = "{{"
+	}
+	if right == "" {
+		right = "}}"
+	}
+	between := regexp.MustCompile(`(>|` + regexp.QuoteMeta(right) + `)[ \t\r]*\n\s*(<|` + regexp.QuoteMeta(left) + `)`)
+
+	var b strings.Builder
+	last := 0
+	for _, loc := range preBlock.FindAllStringIndex(src, -1) {
+		b.WriteString(between.ReplaceAllString(src[last:loc[0]], "$1$2"))
+		b.WriteString(src[loc[0]:loc[1]])
+		last = loc[1]
+	}
+	b.WriteString(between.ReplaceAllString(src[last:], "$1$2"))
+	return b.String()
+}
+
+// rawBlock matches a <script> or <style> element, its content isn't html so comments in it are kept.
+var rawBlock = regexp.MustCompile(`(?is)<script[\s>].*?</script>|<style[\s>].*?</style>`)
+
+// htmlComment matches an html comment, including a conditional comment.
+var htmlComment = regexp.MustCompile(`(?s)<!--.*?-->`)
+
+// keptComment is the prefix of an html comment which isn't stripped, e.g. <!--! license -->
+const keptComment = "<!--!"
+
+// stripComments removes the html comments from the body, outside of <script> and <style> elements. Comments starting
+// with "<!--!" are kept.
+func stripComments(body []byte) []byte {
+	strip := func(b []byte) []byte {
+		return htmlComment.ReplaceAllFunc(b, func(comment []byte) []byte {
+			if bytes.HasPrefix(comment, []byte(keptComment)) {
+				return comment
+			}
+			return nil
+		})
+	}
+
+	var b bytes.Buffer
+	last := 0
+	for _, loc := range rawBlock.FindAllIndex(body, -1) {
+		b.Write(strip(body[last:loc[0]]))
+		b.Write(body[loc[0]:loc[1]])
+		last = loc[1]
+	}
+	b.Write(strip(body[last:]))
+	return b.Bytes()
+}
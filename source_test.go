@@ -0,0 +1,48 @@
+package renderlayout
+
+import (
+	"testing"
+
+	"github.com/foolin/goview"
+)
+
+func TestTrimWhitespace(t *testing.T) {
+	src := "<ul>\n  {{ range . }}\n    <li>{{ . }}</li>\n  {{ end }}\n</ul>\n<pre>\n  <b>kept</b>\n</pre>"
+	want := "<ul>{{ range . }}<li>{{ . }}</li>{{ end }}</ul>\n<pre>\n  <b>kept</b>\n</pre>"
+	if got := trimWhitespace(src, goview.Delims{}); got != want {
+		t.Errorf("trimWhitespace is %q, want %q", got, want)
+	}
+	if got := trimWhitespace("<p>\n  [[ .x ]]\n</p>", goview.Delims{Left: "[[", Right: "]]"}); got != "<p>[[ .x ]]</p>" {
+		t.Errorf("trimWhitespace with delims is %q", got)
+	}
+
+	rnd := newRender(t, map[string]string{
+		"list.html": "{{ define \"content\" }}\n<ul>\n  <li>{{ .hello }}</li>\n</ul>\n{{ end }}",
+	}, TrimWhitespace(true))
+	if body := get(rnd("list", data(D{"hello": "world"}))).Body.String(); body != "<html><ul><li>world</li></ul></html>" {
+		t.Errorf("body is %q", body)
+	}
+}
+
+func TestStripComments(t *testing.T) {
+	body := "<!--[if IE]><p>old</p><![endif]--><p>new</p><!--! MIT license -->" +
+		"<script>var s = '<!-- kept -->';</script><style>/* <!-- kept --> */</style><!-- todo -->"
+	want := "<p>new</p><!--! MIT license --><script>var s = '<!-- kept -->';</script><style>/* <!-- kept --> */</style>"
+	if got := string(stripComments([]byte(body))); got != want {
+		t.Errorf("stripComments is %q, want %q", got, want)
+	}
+
+	files := map[string]string{"page.html": `{{ define "content" }}{{ safeHTML .html }}{{ end }}`}
+	for _, tc := range []struct {
+		strip bool
+		want  string
+	}{
+		{false, "<html>" + body + "</html>"},
+		{true, "<html>" + want + "</html>"},
+	} {
+		rnd := newRender(t, files, StripComments(tc.strip))
+		if got := get(rnd("page", data(D{"html": body}))).Body.String(); got != tc.want {
+			t.Errorf("StripComments(%v) body is %q, want %q", tc.strip, got, tc.want)
+		}
+	}
+}
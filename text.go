@@ -0,0 +1,399 @@
+package renderlayout
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"sync"
+	"sync/atomic"
+	texttemplate "text/template"
+	"text/template/parse"
+
+	"github.com/foolin/goview"
+)
+
+// views renders the views, with html/template or text/template.
+type views interface {
+	RenderWriter(w io.Writer, name string, data interface{}, funcs template.FuncMap) error
+	RenderFragment(out io.Writer, name string, data interface{}, funcs template.FuncMap) error
+	RenderBlock(out io.Writer, name, block string, data interface{}, funcs template.FuncMap) error
+	RenderInline(out io.Writer, src string, data interface{}, funcs template.FuncMap) error
+	RenderLayout(w io.Writer, name, master string, data interface{}, funcs template.FuncMap) error
+	RenderSource(out io.Writer, name, master, src string, data interface{}, fragment bool, funcs template.FuncMap) error
+	Warm(name string) error
+	Dependencies(name string) ([]string, error)
+}
+
+// textEngine renders views like engine, but with text/template, so the output isn't escaped. It shares the
+// configuration and file handling of the engine it's created from. Partials are always parsed and included
+// templates aren't cached.
+type textEngine struct {
+	// hits and misses of the template cache are accessed atomically, first for 64-bit alignment.
+	hits   uint64
+	misses uint64
+
+	config      goview.Config
+	options     []string
+	tplMap      map[tplKey]*texttemplate.Template
+	tplMutex    sync.RWMutex
+	fileHandler goview.FileHandler
+
+	// view returns the template name of the view, and whether it's rendered with the master layout.
+	view func(name string) (string, bool)
+	// partials returns the partials available with the master layout.
+	partials func(master string) []string
+	// placeholderFuncs renders a placeholder for calls to undefined funcs instead of failing to parse.
+	placeholderFuncs bool
+	// skipBrokenPartials leaves out the partials failing to parse with a warning instead of failing the template.
+	skipBrokenPartials bool
+	// callFunc reports whether the func is added by a render, so a template calling it parses without it.
+	callFunc func(name string) bool
+	// partialAliases are the template names of the partials by their alias.
+	partialAliases map[string]string
+}
+
+func newTextEngine(e *engine) *textEngine {
+	return &textEngine{
+		config:             e.config,
+		options:            e.options,
+		tplMap:             make(map[tplKey]*texttemplate.Template),
+		fileHandler:        e.fileHandler,
+		view:               e.view,
+		partials:           e.partials,
+		placeholderFuncs:   e.placeholderFuncs,
+		skipBrokenPartials: e.skipBrokenPartials,
+		callFunc:           e.callFunc,
+		partialAliases:     e.partialAliases,
+	}
+}
+
+// RenderWriter renders the view with io.Writer. funcs are bound to the templates for this render only.
+func (e *textEngine) RenderWriter(w io.Writer, name string, data interface{}, funcs template.FuncMap) error {
+	name, useMaster := e.view(name)
+	return e.executeTemplate(w, name, data, useMaster, funcs)
+}
+
+// RenderLayout renders the view like RenderWriter, but within the master layout, unless it's empty.
+func (e *textEngine) RenderLayout(w io.Writer, name, master string, data interface{}, funcs template.FuncMap) error {
+	name, useMaster := e.view(name)
+	if !useMaster {
+		return e.executeMaster(w, name, "", data, funcs)
+	}
+	return e.executeMaster(w, name, e.layoutMaster(master), data, funcs)
+}
+
+// layoutMaster returns the master layout, or the configured one if it's empty.
+func (e *textEngine) layoutMaster(master string) string {
+	if master == "" {
+		return e.config.Master
+	}
+	return master
+}
+
+// Warm parses and caches the view template.
+func (e *textEngine) Warm(name string) error {
+	if e.config.DisableCache {
+		return nil
+	}
+	name, useMaster := e.view(name)
+	_, err := e.template(name, e.master(useMaster))
+	return err
+}
+
+// Dependencies returns the layout, partial and included files the view is rendered with.
+func (e *textEngine) Dependencies(name string) ([]string, error) {
+	name, useMaster := e.view(name)
+	master := e.master(useMaster)
+	tpl, err := e.template(name, master)
+	if err != nil {
+		return nil, err
+	}
+	exeName := name
+	if master != "" {
+		exeName = master
+	}
+	lookup := func(tpl *texttemplate.Template) func(name string) *parse.Tree {
+		return func(name string) *parse.Tree {
+			if t := tpl.Lookup(name); t != nil {
+				return t.Tree
+			}
+			return nil
+		}
+	}
+	return dependencies(exeName, name, lookup(tpl), func(name string) func(name string) *parse.Tree {
+		tpl, err := e.template(name, "")
+		if err != nil {
+			return nil
+		}
+		return lookup(tpl)
+	}), nil
+}
+
+// RenderFragment renders the view without the master layout. If the view defines the content block, only the
+// block is rendered, otherwise the whole view.
+func (e *textEngine) RenderFragment(out io.Writer, name string, data interface{}, funcs template.FuncMap) error {
+	name, _ = e.view(name)
+	tpl, err := e.template(name, "")
+	if err != nil {
+		return err
+	}
+
+	exeName := name
+	if tpl.Lookup(contentBlock) != nil {
+		exeName = contentBlock
+	}
+	return e.execute(out, tpl, exeName, data, funcs)
+}
+
+// RenderBlock renders the named template defined by the view or the partials, without the master layout.
+func (e *textEngine) RenderBlock(out io.Writer, name, block string, data interface{}, funcs template.FuncMap) error {
+	name, _ = e.view(name)
+	tpl, err := e.template(name, "")
+	if err != nil {
+		return err
+	}
+	if tpl.Lookup(block) == nil {
+		return fmt.Errorf("ViewEngine render block name:%v, error: block %q not defined", name, block)
+	}
+	return e.execute(out, tpl, block, data, funcs)
+}
+
+// RenderInline renders the template source along with the partials, without the master layout. It isn't cached.
+func (e *textEngine) RenderInline(out io.Writer, src string, data interface{}, funcs template.FuncMap) error {
+	tpl, err := e.newTemplate(inlineTemplate).Parse(src)
+	if err != nil {
+		return fmt.Errorf("ViewEngine render parser name:%v, error: %v", inlineTemplate, err)
+	}
+	if err := e.parsePartials(tpl, ""); err != nil {
+		return err
+	}
+	return e.execute(out, tpl, inlineTemplate, data, funcs)
+}
+
+func (e *textEngine) master(useMaster bool) string {
+	if useMaster {
+		return e.config.Master
+	}
+	return ""
+}
+
+func (e *textEngine) executeTemplate(out io.Writer, name string, data interface{}, useMaster bool,
+	funcs template.FuncMap) error {
+	return e.executeMaster(out, name, e.master(useMaster), data, funcs)
+}
+
+// executeMaster executes the template of the view within the master layout, or the view alone without a master.
+func (e *textEngine) executeMaster(out io.Writer, name, master string, data interface{},
+	funcs template.FuncMap) error {
+	tpl, err := e.template(name, master)
+	if err != nil {
+		return err
+	}
+
+	exeName := name
+	if master != "" {
+		exeName = master
+	}
+	return e.execute(out, tpl, exeName, data, funcs)
+}
+
+// execute executes the named template of a clone of tpl, with the funcs bound to the data and the render funcs.
+func (e *textEngine) execute(out io.Writer, tpl *texttemplate.Template, exeName string, data interface{},
+	funcs template.FuncMap) error {
+	tpl, err := tpl.Clone()
+	if err != nil {
+		return err
+	}
+	renderFuncs := texttemplate.FuncMap{
+		"include": func(layout string) (string, error) {
+			buf := new(bytes.Buffer)
+			if err := e.executeTemplate(buf, layout, data, false, funcs); err != nil {
+				return "", err
+			}
+			return buf.String(), nil
+		},
+	}
+	for k, v := range funcs {
+		renderFuncs[k] = v
+	}
+	tpl.Funcs(renderFuncs)
+
+	err = tpl.ExecuteTemplate(out, exeName, data)
+	if err != nil {
+		return fmt.Errorf("ViewEngine execute template error: %v", err)
+	}
+
+	return nil
+}
+
+// template returns the parsed template for the view name, parsing it if it isn't cached. With the cache disabled, it's
+// parsed and not cached.
+func (e *textEngine) template(name, master string) (*texttemplate.Template, error) {
+	if e.config.DisableCache {
+		return e.parseTemplate(name, master, "")
+	}
+
+	key := tplKey{name: name, master: master}
+	e.tplMutex.RLock()
+	tpl, ok := e.tplMap[key]
+	e.tplMutex.RUnlock()
+	if ok {
+		atomic.AddUint64(&e.hits, 1)
+		return tpl, nil
+	}
+	atomic.AddUint64(&e.misses, 1)
+
+	tpl, err := e.parseTemplate(name, master, "")
+	if err != nil {
+		return nil, err
+	}
+
+	e.tplMutex.Lock()
+	e.tplMap[key] = tpl
+	e.tplMutex.Unlock()
+	return tpl, nil
+}
+
+// cacheStats returns the statistics of the template cache.
+func (e *textEngine) cacheStats() CacheStats {
+	e.tplMutex.RLock()
+	size := len(e.tplMap)
+	e.tplMutex.RUnlock()
+	return CacheStats{
+		Hits:   atomic.LoadUint64(&e.hits),
+		Misses: atomic.LoadUint64(&e.misses),
+		Size:   size,
+	}
+}
+
+// parseTemplate parses the template for the view name with the master layout and the partials. The view is parsed
+// from src, unless it's empty.
+func (e *textEngine) parseTemplate(name, master, src string) (*texttemplate.Template, error) {
+	tpl := e.newTemplate(name)
+	if master != "" {
+		if err := e.parse(tpl, master); err != nil {
+			return nil, err
+		}
+	}
+	var err error
+	if src != "" {
+		err = e.parseSource(tpl, name, src)
+	} else {
+		err = e.parse(tpl, name)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := e.parsePartials(tpl, master); err != nil {
+		return nil, err
+	}
+	return tpl, nil
+}
+
+// parsePartials parses the partials available with the master layout into tpl, and defines the partial aliases.
+func (e *textEngine) parsePartials(tpl *texttemplate.Template, master string) error {
+	for _, partial := range e.partials(master) {
+		if err := e.parsePartial(tpl, partial); err != nil {
+			return err
+		}
+	}
+	for alias, partial := range e.partialAliases {
+		if t := tpl.Lookup(partial); t != nil && tpl.Lookup(alias) == nil {
+			if _, err := tpl.AddParseTree(alias, t.Tree); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// RenderSource renders the view like RenderLayout, or like RenderFragment for a fragment, but parsed from src instead
+// of the view's file. It isn't cached.
+func (e *textEngine) RenderSource(out io.Writer, name, master, src string, data interface{}, fragment bool,
+	funcs template.FuncMap) error {
+	name, useMaster := e.view(name)
+	if useMaster && !fragment {
+		master = e.layoutMaster(master)
+	} else {
+		master = ""
+	}
+	tpl, err := e.parseTemplate(name, master, src)
+	if err != nil {
+		return err
+	}
+
+	exeName := name
+	if master != "" {
+		exeName = master
+	} else if fragment && tpl.Lookup(contentBlock) != nil {
+		exeName = contentBlock
+	}
+	return e.execute(out, tpl, exeName, data, funcs)
+}
+
+// newTemplate returns an empty template with the funcs, delimiters and options.
+func (e *textEngine) newTemplate(name string) *texttemplate.Template {
+	allFuncs := texttemplate.FuncMap{
+		"include": func(layout string) (string, error) {
+			return "", nil
+		},
+	}
+	for k, v := range e.config.Funcs {
+		allFuncs[k] = v
+	}
+	return texttemplate.New(name).
+		Funcs(allFuncs).
+		Delims(e.config.Delims.Left, e.config.Delims.Right).
+		Option(e.options...)
+}
+
+// parsePartial parses the partial into tpl. A partial failing to parse is left out with a warning if broken partials
+// are skipped.
+func (e *textEngine) parsePartial(tpl *texttemplate.Template, partial string) error {
+	err := e.parse(tpl, partial)
+	if err != nil && e.skipBrokenPartials {
+		log.Printf("warning => renderlayout:partial [%s] => skipped, %v \n ", partial, err)
+		return nil
+	}
+	return err
+}
+
+// parse parses the template file into tpl, or an associated template named after the file.
+func (e *textEngine) parse(tpl *texttemplate.Template, tplFile string) error {
+	data, err := e.fileHandler(e.config, tplFile)
+	if err != nil {
+		return err
+	}
+	return e.parseSource(tpl, tplFile, data)
+}
+
+// parseSource parses the source of the template file into tpl, or an associated template named after the file.
+func (e *textEngine) parseSource(tpl *texttemplate.Template, tplFile, data string) error {
+	tmpl := tpl
+	if tplFile != tpl.Name() {
+		tmpl = tpl.New(tplFile)
+	}
+	_, err := tmpl.Parse(data)
+	for err != nil {
+		// define the missing func as a placeholder, or a func bound by the render, and parse again.
+		match := undefinedFunc.FindStringSubmatch(err.Error())
+		if match == nil {
+			break
+		}
+		if e.callFunc != nil && e.callFunc(match[1]) {
+			tpl.Funcs(texttemplate.FuncMap{match[1]: unboundFunc(match[1])})
+		} else if e.placeholderFuncs {
+			tpl.Funcs(texttemplate.FuncMap{match[1]: placeholderFunc(match[1])})
+		} else {
+			break
+		}
+		_, err = tmpl.Parse(data)
+	}
+	if err != nil {
+		return fmt.Errorf("ViewEngine render parser name:%v, error: %v", tplFile, err)
+	}
+	return nil
+}
@@ -0,0 +1,26 @@
+package renderlayout
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestTextMode(t *testing.T) {
+	files := map[string]string{"note.html": `{{ define "content" }}{{ .hello }} {{ upper .hello }}{{ end }}`}
+	for _, tc := range []struct {
+		textMode          bool
+		body, contentType string
+	}{
+		{false, "<html>a &lt; b A &lt; B</html>", "text/html; charset=utf-8"},
+		{true, "<html>a < b A < B</html>", "text/plain; charset=utf-8"},
+	} {
+		rnd := newRender(t, files, TextMode(tc.textMode))
+		w := get(rnd("note", data(D{"hello": "a < b"})))
+		if w.Code != http.StatusOK || w.Body.String() != tc.body {
+			t.Errorf("TextMode(%v) response is %d %q, want %q", tc.textMode, w.Code, w.Body.String(), tc.body)
+		}
+		if contentType := w.Header().Get("Content-Type"); contentType != tc.contentType {
+			t.Errorf("TextMode(%v) content type is %q, want %q", tc.textMode, contentType, tc.contentType)
+		}
+	}
+}
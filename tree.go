@@ -0,0 +1,162 @@
+package renderlayout
+
+import (
+	"html/template"
+	"sort"
+	"text/template/parse"
+)
+
+// undefinedRefs returns the names of the templates invoked by tpl or its associated templates, which aren't defined.
+func undefinedRefs(tpl *template.Template) []string {
+	refs := make(map[string]bool)
+	for _, t := range tpl.Templates() {
+		if t.Tree != nil {
+			templateRefs(t.Tree.Root, refs)
+		}
+	}
+
+	var undefined []string
+	for ref := range refs {
+		if t := tpl.Lookup(ref); t == nil || t.Tree == nil {
+			undefined = append(undefined, ref)
+		}
+	}
+	return undefined
+}
+
+// templateRefs adds the names of the templates invoked by {{template "name"}} within node to refs.
+func templateRefs(node parse.Node, refs map[string]bool) {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return
+		}
+		for _, child := range n.Nodes {
+			templateRefs(child, refs)
+		}
+	case *parse.TemplateNode:
+		refs[n.Name] = true
+	case *parse.IfNode:
+		templateRefs(n.List, refs)
+		templateRefs(n.ElseList, refs)
+	case *parse.RangeNode:
+		templateRefs(n.List, refs)
+		templateRefs(n.ElseList, refs)
+	case *parse.WithNode:
+		templateRefs(n.List, refs)
+		templateRefs(n.ElseList, refs)
+	}
+}
+
+// includeRefs adds the names of the templates included by {{include "name"}}, with a constant name, within node to refs.
+func includeRefs(node parse.Node, refs map[string]bool) {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return
+		}
+		for _, child := range n.Nodes {
+			includeRefs(child, refs)
+		}
+	case *parse.ActionNode:
+		includeRefs(n.Pipe, refs)
+	case *parse.PipeNode:
+		if n == nil {
+			return
+		}
+		for _, cmd := range n.Cmds {
+			includeRefs(cmd, refs)
+		}
+	case *parse.CommandNode:
+		if len(n.Args) == 2 {
+			fn, isIdent := n.Args[0].(*parse.IdentifierNode)
+			name, isString := n.Args[1].(*parse.StringNode)
+			if isIdent && isString && fn.Ident == "include" {
+				refs[name.Text] = true
+			}
+		}
+		for _, arg := range n.Args {
+			includeRefs(arg, refs)
+		}
+	case *parse.TemplateNode:
+		includeRefs(n.Pipe, refs)
+	case *parse.IfNode:
+		includeRefs(n.Pipe, refs)
+		includeRefs(n.List, refs)
+		includeRefs(n.ElseList, refs)
+	case *parse.RangeNode:
+		includeRefs(n.Pipe, refs)
+		includeRefs(n.List, refs)
+		includeRefs(n.ElseList, refs)
+	case *parse.WithNode:
+		includeRefs(n.Pipe, refs)
+		includeRefs(n.List, refs)
+		includeRefs(n.ElseList, refs)
+	}
+}
+
+// dependencies returns the template files used to execute the named template, i.e. the files defining it, the
+// templates it invokes and the templates it includes, transitively, except the view's own file. lookup returns the
+// parse tree of a template name, and include returns the lookup of the templates an included template is executed
+// with, or nil if it fails to parse.
+func dependencies(name, view string, lookup func(name string) *parse.Tree,
+	include func(name string) func(name string) *parse.Tree) []string {
+	files := make(map[string]bool)
+	included := make(map[string]bool)
+	var walk func(name string, lookup func(name string) *parse.Tree)
+	walk = func(name string, lookup func(name string) *parse.Tree) {
+		visited := make(map[string]bool)
+		var visit func(name string)
+		visit = func(name string) {
+			if visited[name] {
+				return
+			}
+			visited[name] = true
+			tree := lookup(name)
+			if tree == nil {
+				return
+			}
+			if tree.ParseName != view {
+				files[tree.ParseName] = true
+			}
+			refs := make(map[string]bool)
+			templateRefs(tree.Root, refs)
+			for ref := range refs {
+				visit(ref)
+			}
+			includes := make(map[string]bool)
+			includeRefs(tree.Root, includes)
+			for ref := range includes {
+				if included[ref] {
+					continue
+				}
+				included[ref] = true
+				if includeLookup := include(ref); includeLookup != nil {
+					walk(ref, includeLookup)
+				}
+			}
+		}
+		visit(name)
+	}
+	walk(name, lookup)
+
+	deps := make([]string, 0, len(files))
+	for file := range files {
+		deps = append(deps, file)
+	}
+	sort.Strings(deps)
+	return deps
+}
+
+// isStatic reports whether the template is only text, so it renders the same output for any data.
+func isStatic(tpl *template.Template) bool {
+	if tpl.Tree == nil || tpl.Tree.Root == nil {
+		return false
+	}
+	for _, node := range tpl.Tree.Root.Nodes {
+		if _, ok := node.(*parse.TextNode); !ok {
+			return false
+		}
+	}
+	return true
+}